@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// aggregateNames are the aggregates a column can list, in the order they are
+// reported.
+var aggregateNames = []string{"count", "sum", "avg", "min", "max"}
+
+// columnAggregate accumulates the aggregates of one column over the numeric
+// values of the records written. Nulls aren't counted.
+type columnAggregate struct {
+	label    string
+	wanted   map[string]bool
+	count    int
+	sum      float64
+	min, max float64
+}
+
+// aggregator computes the aggregates of every column that lists some. It
+// isn't safe for concurrent use; records are added under the output lock.
+type aggregator []*columnAggregate
+
+func newAggregator(columns []ColumnConfig) aggregator {
+	var a aggregator
+	for _, col := range columns {
+		if len(col.Aggregate) == 0 {
+			continue
+		}
+		c := &columnAggregate{label: col.Label, wanted: make(map[string]bool), min: math.Inf(1), max: math.Inf(-1)}
+		for _, name := range col.Aggregate {
+			c.wanted[name] = true
+		}
+		a = append(a, c)
+	}
+	return a
+}
+
+// add folds the values of a written record into the aggregates.
+func (a aggregator) add(entry map[string]interface{}) {
+	for _, c := range a {
+		var v float64
+		switch value := entry[c.label].(type) {
+		case int:
+			v = float64(value)
+		case int64:
+			v = float64(value)
+		case float64:
+			v = value
+		default:
+			continue
+		}
+		c.count++
+		c.sum += v
+		c.min = math.Min(c.min, v)
+		c.max = math.Max(c.max, v)
+	}
+}
+
+// results returns the requested aggregates of every column by label. The
+// avg, min and max of a column without values are null.
+func (a aggregator) results() map[string]map[string]interface{} {
+	results := make(map[string]map[string]interface{}, len(a))
+	for _, c := range a {
+		values := make(map[string]interface{}, len(c.wanted))
+		for name := range c.wanted {
+			switch {
+			case name == "count":
+				values[name] = c.count
+			case name == "sum":
+				values[name] = c.sum
+			case c.count == 0:
+				values[name] = nil
+			case name == "avg":
+				values[name] = c.sum / float64(c.count)
+			case name == "min":
+				values[name] = c.min
+			case name == "max":
+				values[name] = c.max
+			}
+		}
+		results[c.label] = values
+	}
+	return results
+}
+
+// print writes one line of aggregates per column to w.
+func (a aggregator) print(w io.Writer) {
+	results := a.results()
+	for _, c := range a {
+		var parts []string
+		for _, name := range aggregateNames {
+			value, ok := results[c.label][name]
+			if !ok {
+				continue
+			}
+			text := "null"
+			switch value := value.(type) {
+			case int:
+				text = strconv.Itoa(value)
+			case float64:
+				text = strconv.FormatFloat(value, 'f', -1, 64)
+			}
+			parts = append(parts, name+"="+text)
+		}
+		fmt.Fprintf(w, "Aggregates of %s: %s\n", c.label, strings.Join(parts, " "))
+	}
+}
+
+// write saves the aggregates as indented JSON.
+func (a aggregator) write(filename string) error {
+	payload, err := json.MarshalIndent(a.results(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, payload, 0644)
+}
+
+// validateAggregates rejects unknown aggregates and aggregates of columns
+// that aren't numeric.
+func validateAggregates(col ColumnConfig) error {
+	if len(col.Aggregate) == 0 {
+		return nil
+	}
+	if !isNumeric(col.Type) {
+		return fmt.Errorf("column %s: aggregate needs an int, float, latitude, longitude or enum column", col.Field)
+	}
+	for _, name := range col.Aggregate {
+		known := false
+		for _, n := range aggregateNames {
+			known = known || n == name
+		}
+		if !known {
+			return fmt.Errorf("column %s: unsupported aggregate %q (use count, sum, avg, min or max)", col.Field, name)
+		}
+	}
+	return nil
+}
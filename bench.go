@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// benchHeader is the header of the generated benchmark dataset, the same
+// columns as data/input.csv so config.yaml and main.py read it unchanged.
+var benchHeader = []string{
+	"employee_id", "first_name", "last_name", "date_of_birth", "ssn", "job_title", "manager",
+	"home_address", "phone", "favorite_movie_quote", "network_ip", "city", "state", "postal_code",
+	"country", "email", "favorite_color", "avatar", "salary", "hire_date", "department",
+	"emergency_contact_name", "emergency_contact_phone", "emergency_contact_relationship",
+	"years_of_experience", "education_level", "marital_status", "gender", "ethnicity",
+	"languages_spoken", "employee_status",
+}
+
+var (
+	benchFirstNames  = []string{"Anna", "Onfroi", "Maria", "Kenji", "Lucia", "Omar", "Greta", "Tariq"}
+	benchLastNames   = []string{"Fury", "McFadyen", "Silva", "Tanaka", "Rossi", "Haddad", "Berg", "Nowak"}
+	benchJobs        = []string{"Media Planner", "Quality Engineer", "Accountant", "Web Developer", "Nurse"}
+	benchQuotes      = []string{"unleash real-time e-markets", "aggregate synergistic web-readiness", "\"quoted\", with a comma"}
+	benchPlaces      = [][3]string{{"Ljungskile", "Västra Götaland", "Sweden"}, {"Meirinhas", "Leiria", "Portugal"}, {"Osaka", "Osaka", "Japan"}}
+	benchColors      = []string{"red", "green", "blue", "purple"}
+	benchDepartments = []string{"Research and Development", "Sales", "Legal", "Support"}
+	benchRelations   = []string{"spouse", "parent", "sibling", "friend"}
+	benchEducation   = []string{"high school", "bachelor's degree", "master's degree", "doctorate"}
+	benchMarital     = []string{"single", "married", "divorced", "widowed"}
+	benchGenders     = []string{"Female", "Male", "Non-binary"}
+	benchEthnicities = []string{"Asian", "Aleut", "White", "Black"}
+	benchLanguages   = []string{"Tajik", "Icelandic", "Spanish", "Hindi"}
+	benchStatuses    = []string{"active", "inactive", "on leave"}
+)
+
+// writeBenchData writes a CSV of rows employee records. The generator is
+// seeded, so the same row count and seed always give the same file.
+func writeBenchData(filename string, rows int, seed int64) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewWriter(file)
+	w := csv.NewWriter(buffered)
+	w.Write(benchHeader)
+
+	rng := rand.New(rand.NewSource(seed))
+	pick := func(values []string) string { return values[rng.Intn(len(values))] }
+	date := func(fromYear, years int) string {
+		return fmt.Sprintf("%d/%d/%d", 1+rng.Intn(12), 1+rng.Intn(28), fromYear+rng.Intn(years))
+	}
+	phone := func() string {
+		return fmt.Sprintf("%03d-%03d-%04d", 100+rng.Intn(900), rng.Intn(1000), rng.Intn(10000))
+	}
+	for i := 1; i <= rows; i++ {
+		first, last := pick(benchFirstNames), pick(benchLastNames)
+		place := benchPlaces[rng.Intn(len(benchPlaces))]
+		w.Write([]string{
+			strconv.Itoa(i), first, last, date(1950, 50),
+			fmt.Sprintf("%03d-%02d-%04d", 100+rng.Intn(900), rng.Intn(100), rng.Intn(10000)),
+			pick(benchJobs), first + " " + last,
+			fmt.Sprintf("%d %s Road", 1+rng.Intn(999), pick(benchLastNames)), phone(), pick(benchQuotes),
+			fmt.Sprintf("%d.%d.%d.%d", rng.Intn(256), rng.Intn(256), rng.Intn(256), rng.Intn(256)),
+			place[0], place[1], fmt.Sprintf("%05d", rng.Intn(100000)), place[2],
+			fmt.Sprintf("user%d@example.com", i), pick(benchColors),
+			fmt.Sprintf("https://robohash.org/%d.png?size=50x50&set=set1", i),
+			strconv.FormatFloat(20000+rng.Float64()*80000, 'f', 2, 64), date(2000, 25), pick(benchDepartments),
+			pick(benchFirstNames) + " " + last, phone(), pick(benchRelations),
+			strconv.Itoa(rng.Intn(40)), pick(benchEducation), pick(benchMarital), pick(benchGenders),
+			pick(benchEthnicities), pick(benchLanguages), pick(benchStatuses),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// benchReport is the machine-readable result of -bench. Durations are in
+// seconds; P95 uses the nearest-rank method.
+type benchReport struct {
+	Input         string    `json:"input"`
+	Config        string    `json:"config"`
+	Rows          int       `json:"rows"`
+	Seed          int64     `json:"seed"`
+	Runs          int       `json:"runs"`
+	Mode          string    `json:"mode"`
+	GoVersion     string    `json:"go_version"`
+	GOMAXPROCS    int       `json:"gomaxprocs"`
+	Seconds       []float64 `json:"seconds"`
+	Min           float64   `json:"min_seconds"`
+	Median        float64   `json:"median_seconds"`
+	P95           float64   `json:"p95_seconds"`
+	Max           float64   `json:"max_seconds"`
+	RowsPerSecond float64   `json:"rows_per_second"`
+}
+
+// runBenchmark converts a generated dataset of opts.benchRows rows opts.bench
+// times with the config of opts and writes a benchReport to opts.benchReport,
+// or stdout; what the runs print goes to stderr. The dataset is kept at
+// opts.benchData when set, and without -output records are written to a
+// temporary file.
+func runBenchmark(opts options) error {
+	dir, err := os.MkdirTemp("", "bench")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	opts.inputFile = opts.benchData
+	if opts.inputFile == "" {
+		opts.inputFile = filepath.Join(dir, "input.csv")
+	}
+	seed := int64(benchSeed)
+	if opts.seed.set {
+		seed = opts.seed.value
+	}
+	if err := writeBenchData(opts.inputFile, opts.benchRows, seed); err != nil {
+		return fmt.Errorf("writing dataset: %v", err)
+	}
+	if len(opts.outputs) == 0 {
+		opts.outputs = outputList{{Path: filepath.Join(dir, "output.json")}}
+	}
+	opts.force = true
+
+	report := benchReport{
+		Input:      opts.inputFile,
+		Config:     opts.configFile,
+		Rows:       opts.benchRows,
+		Seed:       seed,
+		Runs:       opts.bench,
+		Mode:       "concurrent",
+		GoVersion:  runtime.Version(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+	}
+	switch {
+	case opts.sequential:
+		report.Mode = "sequential"
+	case opts.preserveOrder:
+		report.Mode = "preserve-order"
+	}
+	// The progress run prints goes to stderr, so stdout only has the report
+	opts.progress = os.Stderr
+	for i := 0; i < opts.bench; i++ {
+		start := time.Now()
+		run(opts)
+		report.Seconds = append(report.Seconds, time.Since(start).Seconds())
+	}
+
+	sorted := append([]float64(nil), report.Seconds...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	report.Min, report.Max = sorted[0], sorted[n-1]
+	report.Median = sorted[n/2]
+	if n%2 == 0 {
+		report.Median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	report.P95 = sorted[(95*n+99)/100-1]
+	if report.Median > 0 {
+		report.RowsPerSecond = float64(opts.benchRows) / report.Median
+	}
+
+	payload, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if opts.benchReport == "" {
+		_, err = fmt.Println(string(payload))
+		return err
+	}
+	return os.WriteFile(opts.benchReport, payload, 0644)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseColumnsFlag builds the columns of -columns from a spec such as
+// "id:int,name,signup:datetime", naming the columns of a headerless file in
+// order. Columns without a type are strings.
+func parseColumnsFlag(spec string) ([]ColumnConfig, error) {
+	var columns []ColumnConfig
+	seen := make(map[string]bool)
+	for i, part := range strings.Split(spec, ",") {
+		name, columnType, _ := strings.Cut(strings.TrimSpace(part), ":")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("column %d has no name", i+1)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("column %s is listed twice", name)
+		}
+		seen[name] = true
+		columns = append(columns, ColumnConfig{Index: i, Field: name, Label: name, Type: strings.TrimSpace(columnType)})
+	}
+	return columns, nil
+}
+
+// mergeHeaderRows joins the cells of each column of a multi-row header with
+// sep, " / " when empty, skipping empty cells. Empty cells of every row but
+// the last take the value to their left, as spreadsheets leave the cells
+// under a merged group label blank.
+func mergeHeaderRows(rows [][]string, sep string) []string {
+	if sep == "" {
+		sep = " / "
+	}
+	width := 0
+	for _, row := range rows {
+		width = max(width, len(row))
+	}
+
+	header := make([]string, width)
+	for r, row := range rows {
+		group := ""
+		for i := range header {
+			cell := ""
+			if i < len(row) {
+				cell = strings.TrimSpace(row[i])
+			}
+			if r < len(rows)-1 {
+				if cell == "" {
+					cell = group
+				}
+				group = cell
+			}
+			if cell == "" {
+				continue
+			}
+			if header[i] != "" {
+				header[i] += sep
+			}
+			header[i] += cell
+		}
+	}
+	return header
+}
+
+// UnmarshalYAML accepts the index of a column either as a number or as a
+// string holding a single index, a range such as "10-50", or "*" for every
+// column that isn't otherwise configured.
+func (c *ColumnConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ColumnConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	var spec struct {
+		Index interface{} `yaml:"index"`
+	}
+	if err := unmarshal(&spec); err != nil {
+		return err
+	}
+
+	switch v := spec.Index.(type) {
+	case nil:
+	case int:
+		c.Index = v
+	case string:
+		v = strings.TrimSpace(v)
+		if v == "*" {
+			c.wildcard = true
+			return nil
+		}
+		from, to, isRange := strings.Cut(v, "-")
+		first, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return fmt.Errorf("column %s: invalid index %q", c.Field, v)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(strings.TrimSpace(to)); err != nil || last < first {
+				return fmt.Errorf("column %s: invalid index range %q", c.Field, v)
+			}
+			c.indexRange = &[2]int{first, last}
+		}
+		c.Index = first
+	default:
+		return fmt.Errorf("column %s: invalid index %v", c.Field, v)
+	}
+	return nil
+}
+
+// expandColumns replaces range and wildcard columns with one column per
+// index. The expanded columns are named after the header when there is one;
+// otherwise the index is appended to the field and label. width is the
+// number of columns in the file.
+func expandColumns(config *Config, header []string, width int) error {
+	configured := make(map[int]bool)
+	var wildcard *ColumnConfig
+	for i, col := range config.Columns {
+		switch {
+		case col.wildcard:
+			if wildcard != nil {
+				return fmt.Errorf("only one column can use index \"*\"")
+			}
+			wildcard = &config.Columns[i]
+		case len(col.Repeat) > 0:
+			for index := col.Index; index <= repeatSpan(col, width); index++ {
+				configured[index] = true
+			}
+		case col.indexRange != nil:
+			for index := col.indexRange[0]; index <= col.indexRange[1]; index++ {
+				configured[index] = true
+			}
+		case !isComputed(col):
+			configured[col.Index] = true
+		}
+	}
+
+	name := func(base string, index int) string {
+		if index < len(header) && header[index] != "" {
+			return header[index]
+		}
+		if base == "" {
+			base = "column"
+		}
+		return fmt.Sprintf("%s_%d", base, index)
+	}
+	expand := func(col ColumnConfig, index int) ColumnConfig {
+		col.Index = index
+		col.Field = name(col.Field, index)
+		col.Label = name(col.Label, index)
+		col.indexRange = nil
+		col.wildcard = false
+		return col
+	}
+
+	columns := make([]ColumnConfig, 0, len(config.Columns))
+	for _, col := range config.Columns {
+		switch {
+		case col.wildcard:
+			for index := 0; index < width; index++ {
+				if !configured[index] {
+					columns = append(columns, expand(col, index))
+				}
+			}
+		case len(col.Repeat) > 0:
+			// Repeat columns keep their cells together
+			col.repeatEnd = repeatSpan(col, width)
+			columns = append(columns, col)
+		case col.indexRange != nil:
+			for index := col.indexRange[0]; index <= col.indexRange[1]; index++ {
+				columns = append(columns, expand(col, index))
+			}
+		default:
+			columns = append(columns, col)
+		}
+	}
+	config.Columns = columns
+	return nil
+}
+
+// applyTypes sets the type of every column named in the config's types map
+// that doesn't set its own, so a header-driven config only needs to list its
+// non-string columns.
+func applyTypes(config *Config) error {
+	matched := make(map[string]bool, len(config.Types))
+	for i, col := range config.Columns {
+		columnType, ok := config.Types[col.Field]
+		if !ok {
+			continue
+		}
+		matched[col.Field] = true
+		if col.Type == "" {
+			config.Columns[i].Type = columnType
+		}
+	}
+	for name := range config.Types {
+		if !matched[name] {
+			return fmt.Errorf("types: no column named %q", name)
+		}
+	}
+	return nil
+}
+
+// checkHeader compares the configured columns with the header and describes
+// every mismatch: indexes past the end of the header, and fields whose name
+// is in the header but at a different index, which usually means columns
+// were added or moved since the config was written. Fields that aren't header
+// names at all are taken as deliberate renames.
+func checkHeader(config *Config, header []string) []string {
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, exists := positions[name]; !exists {
+			positions[name] = i
+		}
+	}
+
+	var problems []string
+	for _, col := range config.Columns {
+		// Negative indexes are rejected with the column options
+		if isComputed(col) || col.Index < 0 {
+			continue
+		}
+		if col.Index >= len(header) {
+			problems = append(problems, fmt.Sprintf("column %s uses index %d but the header has %d columns", col.Field, col.Index, len(header)))
+			continue
+		}
+		at, named := positions[strings.ToLower(col.Field)]
+		if named && !strings.EqualFold(strings.TrimSpace(header[col.Index]), col.Field) {
+			problems = append(problems, fmt.Sprintf("column %s uses index %d (%q) but the header has %s at index %d", col.Field, col.Index, header[col.Index], col.Field, at))
+		}
+	}
+	return problems
+}
+
+// checkWidth describes every column whose index is past the end of a row of
+// the given width, for input without a header.
+func checkWidth(config *Config, width int) []string {
+	var problems []string
+	for _, col := range config.Columns {
+		end := col.Index
+		if len(col.Repeat) > 0 {
+			end = col.repeatEnd
+		}
+		if !isComputed(col) && end >= width {
+			problems = append(problems, fmt.Sprintf("column %s uses index %d but the first row has %d columns", col.Field, end, width))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// isComputed reports whether a column is derived from other columns instead
+// of being read from its own CSV index.
+func isComputed(col ColumnConfig) bool {
+	return col.Type == "hash"
+}
+
+// rowKey joins the raw values of the given columns into a single key. It is
+// shared by duplicate detection and hash columns so both agree on what makes
+// two rows equal.
+func rowKey(row []string, columns []ColumnConfig) string {
+	var key strings.Builder
+	for _, col := range columns {
+		if isComputed(col) {
+			continue
+		}
+		end := col.Index
+		if len(col.Repeat) > 0 {
+			end = col.repeatEnd
+		}
+		for index := col.Index; index <= end && index < len(row); index++ {
+			key.WriteString(row[index])
+			key.WriteByte('|')
+		}
+	}
+	return key.String()
+}
+
+// resolveComputedColumns links every hash column to the columns named in its
+// sources so rows don't have to look them up.
+func resolveComputedColumns(config *Config) error {
+	byField := make(map[string]ColumnConfig, len(config.Columns))
+	for _, col := range config.Columns {
+		byField[col.Field] = col
+	}
+
+	for i, col := range config.Columns {
+		if col.Type != "hash" {
+			continue
+		}
+		if _, err := newHash(col.Algorithm); err != nil {
+			return fmt.Errorf("column %s: %v", col.Field, err)
+		}
+		if len(col.Sources) == 0 {
+			return fmt.Errorf("column %s: hash column needs at least one source field", col.Field)
+		}
+		sources := make([]ColumnConfig, 0, len(col.Sources))
+		for _, field := range col.Sources {
+			source, ok := byField[field]
+			if !ok || isComputed(source) {
+				return fmt.Errorf("column %s: unknown source field %q", col.Field, field)
+			}
+			sources = append(sources, source)
+		}
+		config.Columns[i].sourceColumns = sources
+	}
+	return nil
+}
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "", "sha256":
+		return sha256.New(), nil
+	case "md5":
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q", algorithm)
+	}
+}
+
+// hashValue returns the hex digest of the column's source values for row.
+func hashValue(row []string, col ColumnConfig) string {
+	h, _ := newHash(col.Algorithm)
+	h.Write([]byte(rowKey(row, col.sourceColumns)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ConditionalDefault fills an empty column with Value when the raw value of
+// another column equals Equals.
+type ConditionalDefault struct {
+	Field  string `yaml:"field"`
+	Equals string `yaml:"equals"`
+	Value  string `yaml:"value"`
+
+	index int
+}
+
+// resolveConditionalDefaults links every default_if rule to the column it
+// compares against.
+func resolveConditionalDefaults(config *Config) error {
+	indices := make(map[string]int, len(config.Columns))
+	for _, col := range config.Columns {
+		if !isComputed(col) {
+			indices[col.Field] = col.Index
+		}
+	}
+	for _, col := range config.Columns {
+		for j, rule := range col.DefaultIf {
+			index, ok := indices[rule.Field]
+			if !ok {
+				return fmt.Errorf("column %s: default_if refers to unknown field %q", col.Field, rule.Field)
+			}
+			col.DefaultIf[j].index = index
+		}
+	}
+	return nil
+}
+
+// conditionalDefault returns the value of the first default_if rule of col
+// that matches row.
+func conditionalDefault(row []string, col ColumnConfig) (string, bool) {
+	for _, rule := range col.DefaultIf {
+		if rule.index < len(row) && row[rule.index] == rule.Equals {
+			return rule.Value, true
+		}
+	}
+	return "", false
+}
+
+// keyValueFlags collects repeated key=value flags.
+type keyValueFlags map[string]string
+
+func (f keyValueFlags) String() string {
+	parts := make([]string, 0, len(f))
+	for k, v := range f {
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f keyValueFlags) Set(value string) error {
+	key, v, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	f[key] = v
+	return nil
+}
+
+// resolveConstants merges -set overrides into the config's constants and
+// rejects values that aren't scalars.
+func resolveConstants(config *Config, overrides keyValueFlags) error {
+	for key, value := range config.Constants {
+		switch value.(type) {
+		case nil, string, int, float64, bool:
+		default:
+			return fmt.Errorf("constant %s must be a string, number or bool", key)
+		}
+	}
+	if len(overrides) > 0 && config.Constants == nil {
+		config.Constants = make(map[string]interface{}, len(overrides))
+	}
+	for key, value := range overrides {
+		config.Constants[key] = value
+	}
+	return nil
+}
+
+// checkMetaKeys rejects metadata key names, including the dedup_count_key,
+// that would overwrite a column or constant in the output.
+func checkMetaKeys(config *Config) error {
+	taken := make(map[string]string, len(config.Columns)+len(config.Constants))
+	for _, col := range config.Columns {
+		taken[col.Label] = "column " + col.Field
+	}
+	for key := range config.Constants {
+		taken[key] = "constant " + key
+	}
+	for _, meta := range []struct{ option, key string }{
+		{"meta_line_key", config.MetaLineKey},
+		{"meta_file_key", config.MetaFileKey},
+		{"dedup_count_key", countKeyOf(config)},
+		{"row_number_key", config.RowNumberKey},
+		{"annotate_errors", errorsKeyOf(config)},
+	} {
+		if meta.key == "" {
+			continue
+		}
+		if owner, ok := taken[meta.key]; ok {
+			return fmt.Errorf("%s %q is already used by %s", meta.option, meta.key, owner)
+		}
+		taken[meta.key] = meta.option
+	}
+	return nil
+}
+
+// rowNumberStart returns the number of the first record with row_number_key.
+func (c *Config) rowNumberStart() int {
+	if c.RowNumberStart == nil {
+		return 1
+	}
+	return *c.RowNumberStart
+}
+
+// numberRecords sets key of every record to its position, counting from
+// start.
+func numberRecords(records []map[string]interface{}, key string, start int) {
+	for i, entry := range records {
+		entry[key] = start + i
+	}
+}
+
+// errorsKey is the key annotate_errors adds.
+const errorsKey = "_errors"
+
+// errorsKeyOf returns errorsKey with annotate_errors, or "" without it.
+func errorsKeyOf(config *Config) string {
+	if !config.AnnotateErrors {
+		return ""
+	}
+	return errorsKey
+}
+
+// countKeyOf returns the key dedup_mode count adds, or "" in other modes.
+func countKeyOf(config *Config) string {
+	if config.DedupMode != "count" {
+		return ""
+	}
+	return config.DedupCountKey
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+)
+
+// profileSamples is how many distinct example values a column profile keeps.
+const profileSamples = 5
+
+// profileTypes are the types a column profile tries, most specific first.
+var profileTypes = []struct {
+	name  string
+	parse func(string) bool
+}{
+	{"int", func(v string) bool { _, err := strconv.Atoi(v); return err == nil }},
+	{"float", func(v string) bool { _, err := strconv.ParseFloat(v, 64); return err == nil }},
+	{"bool", func(v string) bool { _, err := strconv.ParseBool(v); return err == nil }},
+	{"date", func(v string) bool { _, err := time.Parse("2006-01-02", v); return err == nil }},
+	{"datetime", func(v string) bool { _, err := time.Parse(time.RFC3339, v); return err == nil }},
+}
+
+// columnProfile describes the raw values of one column for -profile.
+type columnProfile struct {
+	Field     string      `json:"field"`
+	Label     string      `json:"label"`
+	TypeGuess string      `json:"type_guess"`
+	Values    int         `json:"values"`
+	Nulls     int         `json:"nulls"`
+	NullRate  float64     `json:"null_rate"`
+	Distinct  int         `json:"distinct"`
+	Min       interface{} `json:"min,omitempty"`
+	Max       interface{} `json:"max,omitempty"`
+	Samples   []string    `json:"samples"`
+
+	seen     map[string]struct{}
+	matches  []bool // matches[i] is false once a value fails profileTypes[i]
+	min, max string
+	minN     float64
+	maxN     float64
+}
+
+// profileColumns profiles the raw values of every configured column, treating
+// empty and null values as nulls. Min and max compare as numbers when the
+// column looks numeric and as text otherwise, which orders ISO dates too.
+func profileColumns(records [][]string, columns []ColumnConfig) []*columnProfile {
+	var profiles []*columnProfile
+	for _, col := range columns {
+		if isComputed(col) {
+			continue
+		}
+		p := &columnProfile{
+			Field:   col.Field,
+			Label:   col.Label,
+			Samples: []string{},
+			seen:    make(map[string]struct{}),
+			matches: make([]bool, len(profileTypes)),
+		}
+		for i := range p.matches {
+			p.matches[i] = true
+		}
+
+		for _, row := range records {
+			p.Values++
+			if col.Index >= len(row) || isMissing(row[col.Index], col) {
+				p.Nulls++
+				continue
+			}
+			p.add(row[col.Index])
+		}
+		p.finish()
+		profiles = append(profiles, p)
+	}
+	return profiles
+}
+
+func (p *columnProfile) add(value string) {
+	for i, t := range profileTypes {
+		if p.matches[i] && !t.parse(value) {
+			p.matches[i] = false
+		}
+	}
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		if len(p.seen) == 0 || n < p.minN {
+			p.minN = n
+		}
+		if len(p.seen) == 0 || n > p.maxN {
+			p.maxN = n
+		}
+	}
+	if len(p.seen) == 0 || value < p.min {
+		p.min = value
+	}
+	if len(p.seen) == 0 || value > p.max {
+		p.max = value
+	}
+	if _, ok := p.seen[value]; !ok {
+		p.seen[value] = struct{}{}
+		if len(p.Samples) < profileSamples {
+			p.Samples = append(p.Samples, value)
+		}
+	}
+}
+
+func (p *columnProfile) finish() {
+	p.Distinct = len(p.seen)
+	if p.Values > 0 {
+		p.NullRate = float64(p.Nulls) / float64(p.Values)
+	}
+	p.TypeGuess = "string"
+	if p.Distinct == 0 {
+		return
+	}
+	for i, t := range profileTypes {
+		if p.matches[i] {
+			p.TypeGuess = t.name
+			break
+		}
+	}
+	if p.TypeGuess == "int" || p.TypeGuess == "float" {
+		p.Min, p.Max = p.minN, p.maxN
+	} else {
+		p.Min, p.Max = p.min, p.max
+	}
+}
+
+// writeProfile writes the profile of rows records as indented JSON.
+func writeProfile(filename string, rows int, profiles []*columnProfile) error {
+	payload, err := json.MarshalIndent(map[string]interface{}{
+		"rows":    rows,
+		"columns": profiles,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, payload, 0644)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// dedupShards is the number of independently locked partitions of a
+// dedupSet. Keys are spread over them by hash so concurrent rows rarely wait
+// on each other.
+const dedupShards = 64
+
+// dedupSet tracks which row keys have been seen. It is safe for concurrent
+// use: for every key exactly one caller of add wins and all later callers are
+// counted as duplicates.
+type dedupSet struct {
+	shards []dedupShard
+}
+
+type dedupShard struct {
+	mu      sync.Mutex
+	seen    map[string]struct{}
+	ignored int
+}
+
+func newDedupSet() *dedupSet {
+	return newShardedDedupSet(dedupShards)
+}
+
+// newShardedDedupSet returns a dedupSet split into n shards; n of 1 gives a
+// single lock.
+func newShardedDedupSet(n int) *dedupSet {
+	d := &dedupSet{shards: make([]dedupShard, n)}
+	for i := range d.shards {
+		d.shards[i].seen = make(map[string]struct{})
+	}
+	return d
+}
+
+func (d *dedupSet) shard(key string) *dedupShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &d.shards[h.Sum32()%uint32(len(d.shards))]
+}
+
+// add marks key as seen and reports whether it was new.
+func (d *dedupSet) add(key string) bool {
+	s := d.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.seen[key]; exists {
+		s.ignored++
+		return false
+	}
+	s.seen[key] = struct{}{}
+	return true
+}
+
+// ignoredCount returns how many duplicates add has rejected.
+func (d *dedupSet) ignoredCount() int {
+	total := 0
+	for i := range d.shards {
+		s := &d.shards[i]
+		s.mu.Lock()
+		total += s.ignored
+		s.mu.Unlock()
+	}
+	return total
+}
+
+// uniqueCount returns how many distinct keys add has seen.
+func (d *dedupSet) uniqueCount() int {
+	total := 0
+	for i := range d.shards {
+		s := &d.shards[i]
+		s.mu.Lock()
+		total += len(s.seen)
+		s.mu.Unlock()
+	}
+	return total
+}
+
+// countDuplicates returns how many records are unique and how many repeat
+// an earlier record, using the same key as ignore_duplicates.
+func countDuplicates(records [][]string, columns []ColumnConfig) (unique, duplicates int) {
+	seen := make(map[string]struct{}, len(records))
+	for _, row := range records {
+		key := rowKey(row, columns)
+		if _, exists := seen[key]; exists {
+			duplicates++
+			continue
+		}
+		seen[key] = struct{}{}
+		unique++
+	}
+	return unique, duplicates
+}
+
+// dedupKeep is a parsed dedup_keep option such as "max:updated_at".
+type dedupKeep struct {
+	label string
+	max   bool
+}
+
+// resolveDedup sets the columns that form the duplicate key and parses
+// dedup_keep. With a min or max rule the compared column is left out of the
+// key, so rows that differ only in it fall into the same group.
+func resolveDedup(config *Config) error {
+	config.dedupColumns = config.Columns
+	if err := resolveDedupKeys(config); err != nil {
+		return err
+	}
+	switch config.DedupMode {
+	case "", "drop":
+	case "count":
+		if !config.IgnoreDuplicates {
+			return fmt.Errorf("dedup_mode count needs ignore_duplicates")
+		}
+		if config.DedupCountKey == "" {
+			config.DedupCountKey = "_count"
+		}
+	default:
+		return fmt.Errorf("unsupported dedup_mode %q (use drop or count)", config.DedupMode)
+	}
+	if config.DedupKeep == "" || config.DedupKeep == "first" {
+		return nil
+	}
+	if !config.IgnoreDuplicates {
+		return fmt.Errorf("dedup_keep needs ignore_duplicates")
+	}
+
+	mode, field, _ := strings.Cut(config.DedupKeep, ":")
+	if (mode != "min" && mode != "max") || field == "" {
+		return fmt.Errorf("unsupported dedup_keep %q (use first, min:<field> or max:<field>)", config.DedupKeep)
+	}
+	primary := config.primaryKey()
+	config.dedupColumns = nil
+	for _, col := range config.Columns {
+		if col.Field == field {
+			config.dedupKeep = &dedupKeep{label: col.Label, max: mode == "max"}
+			continue
+		}
+		if primary == nil {
+			config.dedupColumns = append(config.dedupColumns, col)
+		}
+	}
+	if config.dedupKeep == nil {
+		return fmt.Errorf("dedup_keep: unknown column %q", field)
+	}
+	if primary != nil {
+		for _, col := range primary.columns {
+			if col.Field == field {
+				return fmt.Errorf("dedup_keep: column %q can't be part of the primary dedup key %s", field, primary.Name)
+			}
+		}
+		config.dedupColumns = primary.columns
+	}
+	return nil
+}
+
+// DedupKey is a named set of fields whose combined values should be unique.
+// Every key is tracked on its own and reported at the end; only rows that
+// collide on the primary key are dropped, by ignore_duplicates.
+type DedupKey struct {
+	Name    string   `yaml:"name"`
+	Fields  []string `yaml:"fields"`
+	Primary bool     `yaml:"primary"`
+
+	columns []ColumnConfig
+}
+
+// resolveDedupKeys links the fields of every dedup key to their columns and
+// makes the primary key, if any, the duplicate key of ignore_duplicates.
+func resolveDedupKeys(config *Config) error {
+	byField := make(map[string]ColumnConfig, len(config.Columns))
+	for _, col := range config.Columns {
+		byField[col.Field] = col
+	}
+	names := make(map[string]bool, len(config.DedupKeys))
+	var primary *DedupKey
+	for i := range config.DedupKeys {
+		key := &config.DedupKeys[i]
+		switch {
+		case key.Name == "":
+			return fmt.Errorf("dedup key %d has no name", i+1)
+		case names[key.Name]:
+			return fmt.Errorf("dedup key %s is defined twice", key.Name)
+		case len(key.Fields) == 0:
+			return fmt.Errorf("dedup key %s has no fields", key.Name)
+		}
+		names[key.Name] = true
+		key.columns = nil
+		for _, field := range key.Fields {
+			col, ok := byField[field]
+			if !ok || isComputed(col) {
+				return fmt.Errorf("dedup key %s: unknown field %q", key.Name, field)
+			}
+			key.columns = append(key.columns, col)
+		}
+		if key.Primary {
+			if primary != nil {
+				return fmt.Errorf("dedup keys %s and %s are both primary", primary.Name, key.Name)
+			}
+			if !config.IgnoreDuplicates {
+				return fmt.Errorf("dedup key %s: primary needs ignore_duplicates", key.Name)
+			}
+			primary = key
+		}
+	}
+	if primary != nil {
+		config.dedupColumns = primary.columns
+	}
+	return nil
+}
+
+// primaryKey returns the primary dedup key, or nil.
+func (c *Config) primaryKey() *DedupKey {
+	for i := range c.DedupKeys {
+		if c.DedupKeys[i].Primary {
+			return &c.DedupKeys[i]
+		}
+	}
+	return nil
+}
+
+// dedupTracker tracks the values of every dedup key independently.
+type dedupTracker []*dedupSet
+
+func newDedupTracker(config *Config) dedupTracker {
+	t := make(dedupTracker, len(config.DedupKeys))
+	for i := range t {
+		t[i] = newDedupSet()
+	}
+	return t
+}
+
+// add records the row under every key.
+func (t dedupTracker) add(row []string, config *Config) {
+	for i, set := range t {
+		set.add(rowKey(row, config.DedupKeys[i].columns))
+	}
+}
+
+// print reports the unique and duplicate values found for every key.
+func (t dedupTracker) print(w io.Writer, config *Config) {
+	for i, set := range t {
+		fmt.Fprintf(w, "Dedup key %s: %d unique, %d duplicate values\n", config.DedupKeys[i].Name, set.uniqueCount(), set.ignoredCount())
+	}
+}
+
+// dedupKeeper holds the best record seen so far for each duplicate key under
+// a min or max dedup_keep rule, or the earliest one without a rule. It is
+// safe for concurrent use. Ties keep the earlier row, so the result doesn't
+// depend on processing order. With a countKey every kept record gets the
+// number of rows of its key under that key.
+type dedupKeeper struct {
+	mu       sync.Mutex
+	keep     *dedupKeep
+	countKey string
+	best     map[string]keptRecord
+	counts   map[string]int
+	ignored  int
+}
+
+type keptRecord struct {
+	index int
+	entry map[string]interface{}
+}
+
+func newDedupKeeper(keep *dedupKeep, countKey string) *dedupKeeper {
+	return &dedupKeeper{keep: keep, countKey: countKey, best: make(map[string]keptRecord), counts: make(map[string]int)}
+}
+
+// offer considers the record of row index for its key.
+func (k *dedupKeeper) offer(key string, index int, entry map[string]interface{}) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.counts[key]++
+	current, exists := k.best[key]
+	if !exists {
+		k.best[key] = keptRecord{index: index, entry: entry}
+		return
+	}
+	k.ignored++
+	if k.better(index, entry, current) {
+		k.best[key] = keptRecord{index: index, entry: entry}
+	}
+}
+
+// better reports whether the new record beats the current one. Null values
+// always lose to non-null ones.
+func (k *dedupKeeper) better(index int, entry map[string]interface{}, current keptRecord) bool {
+	if k.keep == nil {
+		return index < current.index
+	}
+	a, b := entry[k.keep.label], current.entry[k.keep.label]
+	switch {
+	case a == nil && b == nil:
+	case a == nil:
+		return false
+	case b == nil:
+		return true
+	default:
+		if c := compareValues(a, b); c != 0 {
+			return (c > 0) == k.keep.max
+		}
+	}
+	return index < current.index
+}
+
+// records returns the kept records in input order.
+func (k *dedupKeeper) records() []map[string]interface{} {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	kept := make([]keptRecord, 0, len(k.best))
+	for key, record := range k.best {
+		if k.countKey != "" {
+			record.entry[k.countKey] = k.counts[key]
+		}
+		kept = append(kept, record)
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].index < kept[j].index })
+	records := make([]map[string]interface{}, len(kept))
+	for i, record := range kept {
+		records[i] = record.entry
+	}
+	return records
+}
+
+func (k *dedupKeeper) ignoredCount() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.ignored
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// schemaField describes one key of the output records.
+type schemaField struct {
+	Field    string        `json:"field"`
+	Label    string        `json:"label"`
+	Type     string        `json:"type"`
+	Items    string        `json:"items,omitempty"`
+	Nullable bool          `json:"nullable"`
+	Fields   []schemaField `json:"fields,omitempty"`
+
+	// column is the config of column fields, for format options
+	column ColumnConfig
+}
+
+// outputSchema returns the keys of the records a resolved config produces,
+// in output_order when one is set: the columns, then the constants and the
+// metadata keys. Repeat columns are arrays whose element keys are in Fields.
+func outputSchema(config *Config) ([]schemaField, error) {
+	if config.Unpivot != nil || config.Pivot != nil {
+		return nil, fmt.Errorf("the output of unpivot and pivot configs has no fixed schema")
+	}
+
+	var fields []schemaField
+	for _, col := range config.Columns {
+		field := columnSchema(col)
+		// annotate_errors writes null for values that fail to cast
+		if config.AnnotateErrors && col.Type != "hash" {
+			field.Nullable = true
+		}
+		fields = append(fields, field)
+	}
+	constants := make([]string, 0, len(config.Constants))
+	for key := range config.Constants {
+		constants = append(constants, key)
+	}
+	sort.Strings(constants)
+	for _, key := range constants {
+		value := config.Constants[key]
+		fields = append(fields, schemaField{Field: key, Label: key, Type: constantType(value), Nullable: value == nil})
+	}
+	for _, meta := range []struct{ key, typ string }{
+		{config.MetaLineKey, "int"},
+		{config.MetaFileKey, "string"},
+		{countKeyOf(config), "int"},
+		{config.RowNumberKey, "int"},
+		{errorsKeyOf(config), "array"},
+	} {
+		if meta.key != "" {
+			fields = append(fields, schemaField{Field: meta.key, Label: meta.key, Type: meta.typ})
+		}
+	}
+
+	if config.outputOrder == nil {
+		return fields, nil
+	}
+	byLabel := make(map[string]schemaField, len(fields))
+	for _, field := range fields {
+		byLabel[field.Label] = field
+	}
+	ordered := make([]schemaField, len(config.outputOrder))
+	for i, label := range config.outputOrder {
+		ordered[i] = byLabel[label]
+	}
+	return ordered, nil
+}
+
+// columnSchema describes the output key of a column. Values can only be
+// null under type_policy: nullable or with quoted_empty: null, or with
+// annotate_errors, which outputSchema handles; failed casts under the
+// default policy fall back to the column default.
+func columnSchema(col ColumnConfig) schemaField {
+	field := schemaField{
+		Field:    col.Field,
+		Label:    col.Label,
+		Type:     col.Type,
+		Items:    col.Items,
+		Nullable: col.TypePolicy == "nullable" || col.QuotedEmpty == "null",
+		column:   col,
+	}
+	switch {
+	case len(col.Repeat) > 0:
+		field.Type = "array"
+		for _, element := range col.Repeat {
+			field.Fields = append(field.Fields, columnSchema(element))
+		}
+	case col.Type == "":
+		field.Type = "string"
+	case col.Type == "int" && col.Scale != nil:
+		field.Type = "float"
+	}
+	return field
+}
+
+// constantType names the type of a constant value as a column type.
+func constantType(value interface{}) string {
+	switch value.(type) {
+	case int:
+		return "int"
+	case float64:
+		return "float"
+	case bool:
+		return "bool"
+	}
+	return "string"
+}
+
+// writeOutputSchema writes the output schema of config as indented JSON.
+func writeOutputSchema(filename string, fields []schemaField) error {
+	payload, err := json.MarshalIndent(map[string]interface{}{
+		"fields": fields,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, payload, 0644)
+}
+
+// writeJSONSchema writes the JSON Schema of the output fields, indented.
+func writeJSONSchema(filename string, fields []schemaField) error {
+	payload, err := json.MarshalIndent(jsonSchemaOf(fields), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, payload, 0644)
+}
+
+// ddlTypes maps column types to the SQL type of each -emit-ddl dialect.
+// Types not listed are TEXT, and nested values are stored as JSON.
+var ddlTypes = map[string]map[string]string{
+	"postgres": {
+		"int": "BIGINT", "enum": "BIGINT", "duration": "BIGINT",
+		"float": "DOUBLE PRECISION", "latitude": "DOUBLE PRECISION", "longitude": "DOUBLE PRECISION",
+		"bool": "BOOLEAN", "date": "DATE", "datetime": "TIMESTAMP",
+		"array": "JSONB", "money": "JSONB", "quantity": "JSONB",
+	},
+	"mysql": {
+		"int": "BIGINT", "enum": "BIGINT", "duration": "BIGINT",
+		"float": "DOUBLE", "latitude": "DOUBLE", "longitude": "DOUBLE",
+		"bool": "BOOLEAN", "date": "DATE", "datetime": "DATETIME",
+		"array": "JSON", "money": "JSON", "quantity": "JSON",
+	},
+	"sqlite": {
+		"int": "INTEGER", "enum": "INTEGER", "duration": "INTEGER", "bool": "INTEGER",
+		"float": "REAL", "latitude": "REAL", "longitude": "REAL",
+	},
+}
+
+// createTable returns the CREATE TABLE statement of a table with one column
+// per output field. Fields that can't be null are NOT NULL.
+func createTable(dialect, table string, fields []schemaField) string {
+	quote := func(name string) string {
+		if dialect == "mysql" {
+			return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+		}
+		return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE TABLE %s (\n", quote(table))
+	for i, field := range fields {
+		sqlType, ok := ddlTypes[dialect][field.Type]
+		if !ok {
+			sqlType = "TEXT"
+		}
+		fmt.Fprintf(&b, "  %s %s", quote(field.Label), sqlType)
+		if !field.Nullable {
+			b.WriteString(" NOT NULL")
+		}
+		if i < len(fields)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(");\n")
+	return b.String()
+}
+
+// jsonSchemaOf describes the output records as a JSON Schema document, the
+// counterpart of -schema: labels are the properties, and fields that can't
+// be null are required.
+func jsonSchemaOf(fields []schemaField) map[string]interface{} {
+	schema := objectSchema(fields)
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	return schema
+}
+
+func objectSchema(fields []schemaField) map[string]interface{} {
+	properties := make(map[string]interface{}, len(fields))
+	required := make([]string, 0, len(fields))
+	for _, field := range fields {
+		properties[field.Label] = propertySchema(field)
+		if !field.Nullable {
+			required = append(required, field.Label)
+		}
+	}
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+// propertySchema describes the values of one output field the way they are
+// written, e.g. dates as RFC 3339 timestamps and money as objects.
+func propertySchema(field schemaField) map[string]interface{} {
+	var p map[string]interface{}
+	switch field.Type {
+	case "int", "enum":
+		p = map[string]interface{}{"type": "integer"}
+	case "float", "latitude", "longitude":
+		p = map[string]interface{}{"type": "number"}
+	case "bool":
+		switch field.column.BoolFormat {
+		case "1/0":
+			p = map[string]interface{}{"type": "integer", "enum": []interface{}{0, 1}}
+		case "yes/no":
+			p = map[string]interface{}{"type": "string", "enum": []interface{}{"yes", "no"}}
+		default:
+			p = map[string]interface{}{"type": "boolean"}
+		}
+	case "date", "datetime":
+		p = map[string]interface{}{"type": "string", "format": "date-time"}
+	case "duration":
+		if field.column.DurationFormat == "string" {
+			p = map[string]interface{}{"type": "string"}
+		} else {
+			p = map[string]interface{}{"type": "integer"}
+		}
+	case "ipv4", "ipv6":
+		p = map[string]interface{}{"type": "string", "format": field.Type}
+	case "money":
+		p = objectSchema([]schemaField{{Label: "amount", Type: "float"}, {Label: "currency", Type: "string"}})
+	case "quantity":
+		p = objectSchema([]schemaField{{Label: "value", Type: "float"}, {Label: "unit", Type: "string"}})
+	case "array":
+		p = map[string]interface{}{"type": "array"}
+		switch {
+		case len(field.Fields) > 0:
+			p["items"] = objectSchema(field.Fields)
+		case field.Items != "":
+			p["items"] = propertySchema(schemaField{Type: field.Items, column: field.column})
+		}
+	default:
+		p = map[string]interface{}{"type": "string"}
+	}
+	if field.Nullable {
+		p["type"] = []interface{}{p["type"], "null"}
+	}
+	return p
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// followReader reads a growing file like tail -f: at the end of the file it
+// waits and polls for more data instead of returning io.EOF, until stop
+// reports true. Since it never ends mid-line, a partly written record is
+// simply waited for.
+type followReader struct {
+	r        io.Reader
+	interval time.Duration
+	stop     func() bool
+}
+
+func (f *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		if n > 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+		if f.stop != nil && f.stop() {
+			return 0, io.EOF
+		}
+		time.Sleep(f.interval)
+	}
+}
+
+// followCSV returns a CSV reader over the followed input, having read the
+// header if the config has one.
+func followCSV(r io.Reader, config *Config) ([]string, *csv.Reader, error) {
+	reader := newCSVReader(r, config)
+	if !config.Header {
+		return nil, reader, nil
+	}
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading header: %v", err)
+	}
+	return header, reader, nil
+}
+
+// checkFollow rejects options that need the whole input before writing,
+// or an input that can't grow.
+func checkFollow(opts options, config *Config) error {
+	switch {
+	case isURL(opts.inputFile) || isXLSX(opts.inputFile) || opts.inputFormat == "ndjson":
+		return fmt.Errorf("-follow needs a local CSV file")
+	case config.PreserveQuotedEmpty || config.QuoteChar != "" || config.SkipTrailingRows > 0:
+		return fmt.Errorf("-follow can't be combined with preserve_quoted_empty, quote_char or skip_trailing_rows")
+	case config.Pivot != nil || config.dedupKeep != nil || config.DedupMode == "count" || config.Routing != nil:
+		return fmt.Errorf("-follow can't be combined with pivot, dedup_keep, dedup_mode count or routing")
+	case opts.sortSpec != "" || opts.flatten || opts.chunkSize > 0 || opts.dedupCount:
+		return fmt.Errorf("-follow can't be combined with -sort, -flatten, -chunk-size or -dedup-count")
+	}
+	for _, target := range opts.outputs {
+		if target.Format != "ndjson" {
+			return fmt.Errorf("-follow only writes ndjson, got %s output %s", target.Format, target.Path)
+		}
+	}
+	return nil
+}
+
+// ndjsonStream writes records to NDJSON outputs as they are produced,
+// flushing after every record so readers of the files see them right away.
+type ndjsonStream struct {
+	files   []*outputFile
+	writers []*bufio.Writer
+	opts    outputOptions
+}
+
+func openNDJSONStream(targets outputList, opts outputOptions) (*ndjsonStream, error) {
+	s := &ndjsonStream{opts: opts}
+	for _, target := range targets {
+		file, err := createOutput(target.Path, opts.GzipLevel)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.files = append(s.files, file)
+		s.writers = append(s.writers, bufio.NewWriter(file))
+	}
+	return s, nil
+}
+
+func (s *ndjsonStream) write(entry map[string]interface{}) error {
+	line, err := json.Marshal(s.opts.ordered(entry))
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	for i, w := range s.writers {
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if err := s.files[i].Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ndjsonStream) close() error {
+	var first error
+	for _, file := range s.files {
+		if err := file.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
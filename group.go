@@ -0,0 +1,120 @@
+package main
+
+import "fmt"
+
+// repeatSpan returns the last index of a repeat column: the end of its index
+// range, or the last column of the file when only the first index is given.
+func repeatSpan(col ColumnConfig, width int) int {
+	if col.indexRange != nil {
+		return col.indexRange[1]
+	}
+	return width - 1
+}
+
+// resolveRepeatGroups checks the element fields of repeat columns and
+// prepares them the way top-level columns are prepared, so every cell of a
+// group is cast like a column of its own. Elements without a type_policy use
+// the one of their group.
+func resolveRepeatGroups(config *Config) error {
+	for i, col := range config.Columns {
+		if len(col.Repeat) == 0 {
+			continue
+		}
+		if col.Type != "" {
+			return fmt.Errorf("column %s: repeat columns don't take a type", col.Field)
+		}
+		span := col.repeatEnd - col.Index + 1
+		if col.indexRange != nil && span%len(col.Repeat) != 0 {
+			return fmt.Errorf("column %s: index range %d-%d doesn't hold whole groups of %d fields", col.Field, col.Index, col.repeatEnd, len(col.Repeat))
+		}
+
+		elements := make([]ColumnConfig, len(col.Repeat))
+		for j, field := range col.Repeat {
+			switch {
+			case field.Field == "":
+				return fmt.Errorf("column %s: repeat field %d has no name", col.Field, j+1)
+			case len(field.Repeat) > 0 || isComputed(field):
+				return fmt.Errorf("column %s: repeat field %s can't be a repeat or computed column", col.Field, field.Field)
+			case len(field.DefaultIf) > 0 || field.CurrencyField != "" || field.MaxNullRate != nil:
+				return fmt.Errorf("column %s: repeat field %s can't use default_if, currency_field or max_null_rate", col.Field, field.Field)
+			}
+			if field.Label == "" {
+				field.Label = field.Field
+			}
+			if field.TypePolicy == "" {
+				field.TypePolicy = col.TypePolicy
+			}
+			elements[j] = field
+		}
+
+		group := &Config{Columns: elements, NullValues: config.NullValues, BoolFormat: config.BoolFormat, ControlChars: config.ControlChars}
+		resolveNullValues(group)
+		if err := resolveLayouts(group); err != nil {
+			return fmt.Errorf("column %s: %v", col.Field, err)
+		}
+		if err := resolveReplacements(group); err != nil {
+			return fmt.Errorf("column %s: %v", col.Field, err)
+		}
+		if err := resolvePipelines(group); err != nil {
+			return fmt.Errorf("column %s: %v", col.Field, err)
+		}
+		if err := validateColumnOptions(group); err != nil {
+			return fmt.Errorf("column %s: %v", col.Field, err)
+		}
+		if err := resolveCurrencies(group); err != nil {
+			return fmt.Errorf("column %s: %v", col.Field, err)
+		}
+		if err := resolveBoolFormats(group); err != nil {
+			return fmt.Errorf("column %s: %v", col.Field, err)
+		}
+		if err := resolveControlChars(group); err != nil {
+			return fmt.Errorf("column %s: %v", col.Field, err)
+		}
+		config.Columns[i].Repeat = group.Columns
+	}
+	return nil
+}
+
+// repeatValue collapses the cells of a repeat column into an array with one
+// object per group of cells. Groups whose cells are all missing are left
+// out, as are cells past the end of the row. warn receives the warnings of
+// the element casts, named after the group, for example "items[2].qty".
+func repeatValue(row []string, col ColumnConfig, warn func(field, message string)) ([]interface{}, error) {
+	values := make([]interface{}, 0)
+	n := len(col.Repeat)
+	cells := make([]string, n)
+	for start := col.Index; start+n-1 <= col.repeatEnd && start < len(row); start += n {
+		empty := true
+		for j, field := range col.Repeat {
+			cells[j] = ""
+			if start+j < len(row) {
+				cells[j] = applyReplacements(row[start+j], field)
+			}
+			if isMissing(cells[j], field) {
+				cells[j] = ""
+			} else {
+				empty = false
+			}
+		}
+		if empty {
+			continue
+		}
+
+		element := make(map[string]interface{}, n)
+		for j, field := range col.Repeat {
+			raw := cells[j]
+			name := fmt.Sprintf("%s[%d].%s", col.Field, len(values)+1, field.Field)
+			field.Field = name
+			value, outcome, err := castValue(raw, field)
+			if err != nil {
+				return nil, err
+			}
+			if outcome.Warning != "" {
+				warn(name, outcome.Warning)
+			}
+			element[field.Label] = value
+		}
+		values = append(values, element)
+	}
+	return values, nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// headerFlags collects repeated "Name: value" flags into HTTP headers.
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	parts := make([]string, 0, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			parts = append(parts, name+": "+v)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h headerFlags) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("expected \"Name: value\", got %q", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(v))
+	return nil
+}
+
+// isURL reports whether path should be fetched over HTTP instead of opened
+// as a file.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// openInput opens a local file or fetches a URL with the given headers. The
+// request, including reading its body, is cancelled when ctx is done.
+func openInput(ctx context.Context, path string, headers http.Header) (io.ReadCloser, error) {
+	if !isURL(path) {
+		return os.Open(path)
+	}
+	return fetchURL(ctx, path, headers)
+}
+
+// fetchURL GETs url and returns the response body, transparently decoding
+// gzip responses.
+func fetchURL(ctx context.Context, url string, headers http.Header) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	// Asking for gzip explicitly turns off the transport's own decoding, so
+	// the body is decoded below whenever the server compressed it
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp.Body, nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return gzipBody{gz, resp.Body}, nil
+}
+
+// readConfigData returns the contents of a config file, or of a URL fetched
+// with the given headers.
+func readConfigData(path string, headers http.Header) ([]byte, error) {
+	if !isURL(path) {
+		return os.ReadFile(path)
+	}
+	body, err := fetchURL(context.Background(), path, headers)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// gzipBody closes both the gzip reader and the response body underneath it.
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g gzipBody) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+// inputDelimiters maps the delimited -input-format values to their field
+// separator.
+var inputDelimiters = map[string]rune{
+	"csv": ',',
+	"tsv": '\t',
+	"psv": '|',
+	"ssv": ';',
+}
+
+// newCSVReader returns a CSV reader over r using the config's record and field
+// separators.
+func newCSVReader(r io.Reader, config *Config) *csv.Reader {
+	reader := csv.NewReader(newSeparatorReader(r, config.RecordSeparator))
+	if config.comma != 0 {
+		reader.Comma = config.comma
+	}
+	return reader
+}
+
+// readCSV reads every record of r, returning the first one separately as the
+// header when the config has one.
+func readCSV(r io.Reader, config *Config) ([]string, [][]string, error) {
+	reader := newCSVReader(r, config)
+
+	var header []string
+	if config.Header {
+		var err error
+		header, err = reader.Read()
+		if err == io.EOF {
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading header: %v", err)
+		}
+	}
+	records, err := reader.ReadAll()
+	return header, records, err
+}
+
+// countCSV counts the records of r without keeping them, reusing one record
+// buffer. When the config ignores duplicates it also counts the unique ones.
+// resolve is called with the header and the width of the first record before
+// any key is built, so columns can be resolved as for a full run.
+func countCSV(r io.Reader, config *Config, resolve func(header []string, width int) error) (total, unique int, err error) {
+	reader := newCSVReader(r, config)
+	reader.ReuseRecord = true
+
+	var header []string
+	if config.Header {
+		row, err := reader.Read()
+		if err != nil && err != io.EOF {
+			return 0, 0, fmt.Errorf("reading header: %v", err)
+		}
+		header = append(header, row...)
+	}
+
+	var seen map[string]struct{}
+	for resolved := false; ; {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if !resolved {
+			width := len(header)
+			if width == 0 {
+				width = len(row)
+			}
+			if err := resolve(header, width); err != nil {
+				return 0, 0, err
+			}
+			if config.IgnoreDuplicates {
+				seen = make(map[string]struct{})
+			}
+			resolved = true
+		}
+		total++
+		if seen != nil {
+			seen[rowKey(row, config.dedupColumns)] = struct{}{}
+		}
+	}
+	return total, len(seen), nil
+}
+
+// peekCSV reads only the header, if the config has one, and the first record
+// of r, returning the header and the width columns are resolved against.
+func peekCSV(r io.Reader, config *Config) ([]string, int, error) {
+	reader := newCSVReader(r, config)
+
+	var header []string
+	if config.Header {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil, 0, nil
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading header: %v", err)
+		}
+		header = row
+	}
+	if len(header) > 0 {
+		return header, len(header), nil
+	}
+	row, err := reader.Read()
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	return header, len(row), nil
+}
+
+// readNDJSON reads one JSON object per line into a table with one cell per
+// config column, looked up by label, field and then aliases, and points each
+// column's index at its cell. The returned header holds the labels. The config
+// is switched to no header, so line numbers in warnings count from the first
+// line.
+func readNDJSON(r io.Reader, config *Config) ([]string, [][]string, error) {
+	header := make([]string, len(config.Columns))
+	names := make([][]string, len(config.Columns))
+	explode := -1
+	for i, col := range config.Columns {
+		if col.wildcard || col.indexRange != nil || len(col.Repeat) > 0 {
+			return nil, nil, fmt.Errorf("column %s: index ranges, wildcards and repeat columns need CSV input", col.Field)
+		}
+		if col.Unnest == "explode" {
+			if explode >= 0 {
+				return nil, nil, fmt.Errorf("column %s: only one column can use unnest: explode", col.Field)
+			}
+			explode = i
+		}
+		config.Columns[i].Index = i
+		header[i] = col.Label
+		names[i] = append([]string{col.Label, col.Field}, col.Aliases...)
+	}
+	config.Header = false
+
+	var records [][]string
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			var object map[string]json.RawMessage
+			if err := json.Unmarshal(data, &object); err != nil {
+				return nil, nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			row := make([]string, len(config.Columns))
+			var elements []string
+			for i, col := range config.Columns {
+				for _, name := range names[i] {
+					value, ok := object[name]
+					if !ok {
+						continue
+					}
+					row[i] = jsonCell(value)
+					if items, isArray := jsonArray(value); isArray {
+						switch col.Unnest {
+						case "join":
+							row[i] = strings.Join(items, col.joinSeparator())
+						case "explode":
+							// An empty array keeps its row, with an empty cell
+							row[i] = ""
+							elements = items
+						}
+					}
+					break
+				}
+			}
+			if len(elements) == 0 {
+				records = append(records, row)
+			}
+			for _, element := range elements {
+				exploded := append([]string(nil), row...)
+				exploded[explode] = element
+				records = append(records, exploded)
+			}
+		}
+		if err == io.EOF {
+			return header, records, nil
+		}
+	}
+}
+
+// jsonCell renders a JSON value as the text a CSV cell would hold: strings
+// unquoted, null as empty, and everything else as its JSON text.
+func jsonCell(value json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		return s
+	}
+	if text := string(bytes.TrimSpace(value)); text != "null" {
+		return text
+	}
+	return ""
+}
+
+// jsonArray returns the elements of a JSON array rendered as cells, and false
+// when the value isn't an array.
+func jsonArray(value json.RawMessage) ([]string, bool) {
+	var elements []json.RawMessage
+	if err := json.Unmarshal(value, &elements); err != nil || elements == nil {
+		return nil, false
+	}
+	items := make([]string, len(elements))
+	for i, element := range elements {
+		items[i] = jsonCell(element)
+	}
+	return items, true
+}
+
+// joinSeparator returns the separator that unnest: join puts between array
+// elements, a comma by default.
+func (c ColumnConfig) joinSeparator() string {
+	if c.JoinSeparator == "" {
+		return ","
+	}
+	return c.JoinSeparator
+}
+
+// separatorReader rewrites a custom record separator to "\n" so that
+// encoding/csv, which only understands "\n" and "\r\n", can split records.
+// The rewrite happens before CSV parsing, so separators inside quoted fields
+// are rewritten too, and any "\n" already in the input still ends a record.
+type separatorReader struct {
+	r       io.Reader
+	sep     []byte
+	chunk   []byte
+	pending []byte
+	out     []byte
+	err     error
+}
+
+func newSeparatorReader(r io.Reader, sep string) io.Reader {
+	if sep == "" || sep == "\n" || sep == "\r\n" {
+		return r
+	}
+	return &separatorReader{r: r, sep: []byte(sep), chunk: make([]byte, 32*1024)}
+}
+
+func (s *separatorReader) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		n, err := s.r.Read(s.chunk)
+		s.pending = append(s.pending, s.chunk[:n]...)
+		s.err = err
+
+		i := 0
+		for i+len(s.sep) <= len(s.pending) {
+			if bytes.HasPrefix(s.pending[i:], s.sep) {
+				s.out = append(s.out, '\n')
+				i += len(s.sep)
+			} else {
+				s.out = append(s.out, s.pending[i])
+				i++
+			}
+		}
+		// Whatever is left is shorter than the separator and may be the start
+		// of one, so hold it back until more input arrives
+		if s.err != nil {
+			s.out = append(s.out, s.pending[i:]...)
+			i = len(s.pending)
+		}
+		s.pending = append(s.pending[:0], s.pending[i:]...)
+	}
+
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// resolveAliases points every column that lists aliases at the first of its
+// field name or aliases present in the header. Columns without a match keep
+// their configured index.
+func resolveAliases(config *Config, header []string) {
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, exists := positions[name]; !exists {
+			positions[name] = i
+		}
+	}
+
+	for i, col := range config.Columns {
+		if len(col.Aliases) == 0 {
+			continue
+		}
+		found := false
+		for _, name := range append([]string{col.Field}, col.Aliases...) {
+			if index, ok := positions[strings.ToLower(name)]; ok {
+				config.Columns[i].Index = index
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Printf("Warning: none of the names for column %s found in header, using index %d", col.Field, col.Index)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// keyOrders lists the values of -key-order.
+var keyOrders = map[string]bool{
+	"sorted": true,
+	"alpha":  true,
+	"config": true,
+}
+
+// orderedRecord is a record that marshals its keys in a given order instead
+// of the sorted order encoding/json uses for maps.
+type orderedRecord struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (r orderedRecord) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(r.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// orderKeys returns the keys of entry in the given order: "alpha" sorts them
+// ignoring case, and "config" puts the labels first, in config order, followed
+// by any other keys, such as constants, sorted.
+func orderKeys(entry map[string]interface{}, order string, labels []string) []string {
+	keys := make([]string, 0, len(entry))
+	placed := make(map[string]bool)
+	if order == "config" {
+		for _, label := range labels {
+			if _, ok := entry[label]; ok && !placed[label] {
+				keys = append(keys, label)
+				placed[label] = true
+			}
+		}
+	}
+	configured := len(keys)
+	for key := range entry {
+		if !placed[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	rest := keys[configured:]
+	if order == "alpha" {
+		sort.Slice(rest, func(i, j int) bool {
+			a, b := strings.ToLower(rest[i]), strings.ToLower(rest[j])
+			if a != b {
+				return a < b
+			}
+			return rest[i] < rest[j]
+		})
+	} else {
+		sort.Strings(rest)
+	}
+	return keys
+}
+
+// ordered returns entry ready to marshal with the keys in opts.KeyOrder.
+// Sorted order is what encoding/json already does for maps, so entry is
+// returned as is.
+func (opts outputOptions) ordered(entry map[string]interface{}) interface{} {
+	if opts.KeyOrder == "" || opts.KeyOrder == "sorted" {
+		return entry
+	}
+	return orderedRecord{keys: orderKeys(entry, opts.KeyOrder, opts.Labels), values: entry}
+}
+
+// resolveOutputOrder turns the config's output_order into the list of output
+// keys in that order. Entries name columns by field or label, constants or
+// metadata keys, and "*" stands for every key not listed, in config order
+// followed by constants and metadata keys. Without "*" those keys go last.
+func resolveOutputOrder(config *Config) ([]string, error) {
+	if len(config.OutputOrder) == 0 {
+		return nil, nil
+	}
+
+	names := outputLabels(config)
+	var all []string
+	for _, col := range config.Columns {
+		all = append(all, col.Label)
+	}
+	constants := make([]string, 0, len(config.Constants))
+	for key := range config.Constants {
+		constants = append(constants, key)
+	}
+	sort.Strings(constants)
+	all = append(all, constants...)
+	for _, key := range []string{config.MetaLineKey, config.MetaFileKey, countKeyOf(config), config.RowNumberKey, errorsKeyOf(config)} {
+		if key != "" {
+			names[key] = key
+			all = append(all, key)
+		}
+	}
+
+	listed := make(map[string]bool, len(config.OutputOrder))
+	rest := -1
+	for _, name := range config.OutputOrder {
+		if name == "*" {
+			if rest >= 0 {
+				return nil, fmt.Errorf("output_order: \"*\" can only appear once")
+			}
+			rest = len(listed)
+			continue
+		}
+		label, ok := names[name]
+		if !ok {
+			return nil, fmt.Errorf("output_order: unknown field %q", name)
+		}
+		if listed[label] {
+			return nil, fmt.Errorf("output_order: %q is listed twice", name)
+		}
+		listed[label] = true
+	}
+
+	order := make([]string, 0, len(all))
+	var remaining []string
+	for _, label := range all {
+		if !listed[label] {
+			remaining = append(remaining, label)
+		}
+	}
+	for _, name := range config.OutputOrder {
+		if name == "*" {
+			order = append(order, remaining...)
+			continue
+		}
+		order = append(order, names[name])
+	}
+	if rest < 0 {
+		order = append(order, remaining...)
+	}
+	return order, nil
+}
@@ -1,220 +1,1552 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/csv"
-	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
+	"google.golang.org/protobuf/reflect/protoreflect"
 	"gopkg.in/yaml.v2"
 )
 
 type ColumnConfig struct {
-	Index      int    `yaml:"index"`
+	Index      int    `yaml:"-"` // set by UnmarshalYAML
 	Field      string `yaml:"field"`
 	Label      string `yaml:"label"`
 	Type       string `yaml:"type"`
 	TypePolicy string `yaml:"type_policy"`
 	Default    string `yaml:"default"`
+	// LeadingZeros controls numeric casts that would drop leading zeros:
+	// "ignore" (default), "warn" or "strict"
+	LeadingZeros string `yaml:"leading_zeros"`
+	// BoolFormat sets how bool values are written: "true/false", "1/0" or "yes/no"
+	BoolFormat string `yaml:"bool_format"`
+	// QuotedEmpty decides what an explicitly quoted empty value ("") becomes
+	// with preserve_quoted_empty: "missing" (default), "empty" or "null"
+	QuotedEmpty string `yaml:"quoted_empty"`
+	// NullValues replaces the global null_values for this column
+	NullValues []string `yaml:"null_values"`
+	// ControlChars replaces the global control_chars for this column
+	ControlChars string `yaml:"control_chars"`
+	// Aliases are alternative header names for Field; the first one found in
+	// the header sets Index
+	Aliases []string `yaml:"aliases"`
+	// DefaultIf rules replace Default for empty values, based on other columns
+	DefaultIf []ConditionalDefault `yaml:"default_if"`
+	// DurationFormat is "nanoseconds" (default) or "string"
+	DurationFormat string `yaml:"duration_format"`
+	// Normalize rewrites values into their canonical form, e.g. for ip columns
+	Normalize bool `yaml:"normalize"`
+	// Items is the element type of array columns; untyped arrays are kept as
+	// decoded from JSON
+	Items string `yaml:"items"`
+	// Scale multiplies numeric values after casting, e.g. 0.01 for cents to
+	// dollars; scaled int columns emit floats
+	Scale *float64 `yaml:"scale"`
+	// Round rounds numeric values to this many decimal places after scaling
+	Round *int `yaml:"round"`
+	// Currency is the fixed currency of money columns, and CurrencyField the
+	// column holding it per row instead
+	Currency      string `yaml:"currency"`
+	CurrencyField string `yaml:"currency_field"`
+	// Codes maps the values of enum columns to the integers they are written as
+	Codes map[string]int `yaml:"codes"`
+	// Units maps the units of quantity columns to their factor to BaseUnit,
+	// e.g. {kg: 1000, g: 1} with base_unit g; values are converted to the
+	// base unit and other units fail the cast
+	Units    map[string]float64 `yaml:"units"`
+	BaseUnit string             `yaml:"base_unit"`
+	// Region is the default ISO 3166 region, such as "US", of phone numbers
+	// written without a country code
+	Region string `yaml:"region"`
+	// Timezone is the IANA zone, such as "Europe/Madrid", that datetime
+	// values are in when their format carries no offset; they are written as
+	// UTC
+	Timezone string `yaml:"timezone"`
+	// TrimChars lists characters stripped from both ends of the value before
+	// casting, e.g. "\";" for stray quotes and semicolons
+	TrimChars string `yaml:"trim_chars"`
+	// Replace rules rewrite the value in order before casting, after
+	// TrimChars
+	Replace []ReplaceRule `yaml:"replace"`
+	// Pipeline lists transform steps, such as "trim", "replace:,=." or
+	// "validate:[0-9]+", applied in order before casting, after Replace
+	Pipeline []string `yaml:"pipeline"`
+	// Format is a strftime-style layout for date and datetime columns, such
+	// as "%m/%d/%Y"
+	Format string `yaml:"format"`
+
+	// Repeat lists the fields of each element of a repeat column, whose
+	// cells are collapsed into an array of objects, one per group of cells
+	Repeat []ColumnConfig `yaml:"repeat"`
+
+	// MaxNullRate is the highest share, from 0 to 1, of values that may end
+	// up null or defaulted before the run fails or warns, see null_rate_policy
+	MaxNullRate *float64 `yaml:"max_null_rate"`
+
+	// Aggregate lists the aggregates of a numeric column computed over the
+	// written records: count, sum, avg, min and max
+	Aggregate []string `yaml:"aggregate"`
+
+	// Unnest decides what NDJSON input does with an array value: "explode"
+	// into one row per element, or "join" the elements with JoinSeparator
+	Unnest        string `yaml:"unnest"`
+	JoinSeparator string `yaml:"join_separator"`
+	// MinLength and MaxLength bound the number of characters of non-empty
+	// values; values out of bounds follow TypePolicy, unless Truncate cuts
+	// long values to MaxLength
+	MinLength *int `yaml:"min_length"`
+	MaxLength *int `yaml:"max_length"`
+	Truncate  bool `yaml:"truncate"`
+
+	// Hash columns are computed from the raw values of Sources
+	Algorithm string   `yaml:"algorithm"`
+	Sources   []string `yaml:"sources"`
+
+	sourceColumns []ColumnConfig
+	pipeline      []pipelineStep
+	layout        string
+	location      *time.Location
+	currencyIndex int
+	itemColumn    *ColumnConfig
+	indexRange    *[2]int
+	repeatEnd     int
+	wildcard      bool
+	nullValues    map[string]struct{}
 }
 
 type Config struct {
-	Header           bool           `yaml:"header"`
+	Header bool `yaml:"header"`
+	// HeaderRows is the number of rows the header spans, 1 by default. The
+	// cells of each column are joined with HeaderSeparator (" / " by
+	// default) into its name, e.g. "Sales / Q1"
+	HeaderRows      int    `yaml:"header_rows"`
+	HeaderSeparator string `yaml:"header_separator"`
+	// HeaderCheck is what to do when columns don't match the header: "warn"
+	// (default), "error" or "off"
+	HeaderCheck string `yaml:"header_check"`
+	// NullRatePolicy is what happens when a column exceeds its max_null_rate:
+	// "error" (default) exits with an error once output is written, "warn"
+	// only logs it
+	NullRatePolicy   string         `yaml:"null_rate_policy"`
 	Columns          []ColumnConfig `yaml:"columns"`
 	IgnoreDuplicates bool           `yaml:"ignore_duplicates"`
+	// DedupKeep picks which record of a duplicate group is kept: "first"
+	// (default), or "min:<field>" / "max:<field>" for the lowest or highest
+	// value of that column
+	DedupKeep string `yaml:"dedup_keep"`
+	// DedupMode "count" keeps one record per duplicate key, like the default
+	// "drop", and adds the number of rows of the key under DedupCountKey
+	// ("_count" by default)
+	DedupMode     string `yaml:"dedup_mode"`
+	DedupCountKey string `yaml:"dedup_count_key"`
+	// DedupKeys are named field sets tracked for uniqueness and reported on
+	// their own; the primary one, if any, is the key ignore_duplicates uses
+	DedupKeys       []DedupKey     `yaml:"dedup_keys"`
+	Unpivot         *UnpivotConfig `yaml:"unpivot"`
+	Pivot           *PivotConfig   `yaml:"pivot"`
+	RecordSeparator string         `yaml:"record_separator"`
+	SkipEmptyRows   bool           `yaml:"skip_empty_rows"`
+	// SkipTrailingRows drops the last rows of the input, such as "Total" lines
+	// at the bottom of a report
+	SkipTrailingRows int `yaml:"skip_trailing_rows"`
+	// PreserveQuotedEmpty parses the CSV with a custom reader that can tell
+	// "" apart from an empty field, see quoted_empty
+	PreserveQuotedEmpty bool   `yaml:"preserve_quoted_empty"`
+	BoolFormat          string `yaml:"bool_format"`
+	// QuoteChar replaces " as the quote character of CSV input, such as '
+	// or `; the input is then read with quoteAwareParser
+	QuoteChar string `yaml:"quote_char"`
+	// NullValues are cell values treated as missing, such as "NULL" or "N/A"
+	NullValues []string `yaml:"null_values"`
+	// ControlChars is what happens to NUL and other control characters in
+	// values, except tabs and line breaks: "keep" (default), "strip" them,
+	// replace each with a "space", or "reject" the value
+	ControlChars string `yaml:"control_chars"`
+	// Types sets the type of columns by field name, typically header names
+	// when columns are left out
+	Types map[string]string `yaml:"types"`
+	// Constants are added unchanged to every output record
+	Constants map[string]interface{} `yaml:"constants"`
+	// MetaLineKey and MetaFileKey, when set, name the keys that receive the
+	// source line number and input file of every record
+	MetaLineKey string `yaml:"meta_line_key"`
+	MetaFileKey string `yaml:"meta_file_key"`
+	// RowNumberKey, when set, names the key that numbers the records in the
+	// order they are written, counting from RowNumberStart (1 by default)
+	RowNumberKey   string `yaml:"row_number_key"`
+	RowNumberStart *int   `yaml:"row_number_start"`
+	// AnnotateErrors adds the cast and validation problems of every record to
+	// it under "_errors", instead of aborting on them
+	AnnotateErrors bool `yaml:"annotate_errors"`
+	// OutputOrder lists output keys in the order CSV columns and, with
+	// -key-order config, JSON keys are written in; "*" stands for the rest
+	OutputOrder []string `yaml:"output_order"`
+	// Routing writes records to different outputs depending on their values,
+	// in addition to -output
+	Routing *RoutingConfig `yaml:"routing"`
+
+	dedupColumns []ColumnConfig
+	dedupKeep    *dedupKeep
+	outputOrder  []string
+	// comma is the field separator of delimited input, from -input-format
+	comma rune
+	// typeLibrary holds the named column types of -types
+	typeLibrary map[string]FieldType
 }
 
-func loadConfig(filename string) (*Config, error) {
-	data, err := os.ReadFile(filename)
+// loadConfig reads the config from a file, or from a URL fetched with the
+// given headers, and merges each overlay onto it in turn.
+func loadConfig(filename string, headers http.Header, overlays []string) (*Config, error) {
+	keys, data, err := readConfigMapping(filename, headers)
 	if err != nil {
 		return nil, err
 	}
+	if len(overlays) > 0 {
+		for _, overlay := range overlays {
+			layer, _, err := readConfigMapping(overlay, headers)
+			if err != nil {
+				return nil, err
+			}
+			if keys, err = mergeConfig(keys, layer); err != nil {
+				return nil, fmt.Errorf("%s: %v", overlay, err)
+			}
+		}
+		if data, err = yaml.Marshal(keys); err != nil {
+			return nil, err
+		}
+	}
+
 	var config Config
 	err = yaml.Unmarshal(data, &config)
 	if err != nil {
 		return nil, err
 	}
+	if len(config.Columns) == 0 && !config.Header && len(config.Types) == 0 {
+		return nil, fmt.Errorf("%s: no columns configured; add a columns list, or header: true to pass every column through", filename)
+	}
+	if config.QuoteChar != "" && (utf8.RuneCountInString(config.QuoteChar) != 1 || strings.ContainsAny(config.QuoteChar, "\r\n")) {
+		return nil, fmt.Errorf("%s: quote_char must be a single character, got %q", filename, config.QuoteChar)
+	}
 	return &config, nil
 }
 
-func parseDate(value, defaultValue string) time.Time {
-	layout := "2006-01-02"
-	if parsed, err := time.Parse(layout, value); err == nil {
-		return parsed
+// readConfigMapping reads one config document, returning it decoded and as
+// text. The shape is checked first: a list or scalar document, or a config
+// whose keys are all misspelled, would otherwise unmarshal into an empty
+// Config.
+func readConfigMapping(filename string, headers http.Header) (map[interface{}]interface{}, []byte, error) {
+	data, err := readConfigData(filename, headers)
+	if err != nil {
+		return nil, nil, err
 	}
-	parsed, _ := time.Parse(layout, defaultValue)
-	return parsed
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, nil, err
+	}
+	keys, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: expected a mapping with header, columns and other settings, got %s", filename, yamlKind(raw))
+	}
+	if columns, ok := keys["columns"]; ok && columns != nil {
+		if _, isList := columns.([]interface{}); !isList {
+			return nil, nil, fmt.Errorf("%s: columns must be a list of column settings, got %s", filename, yamlKind(columns))
+		}
+	}
+	known := configKeys()
+	for key := range keys {
+		if name := fmt.Sprint(key); !known[name] {
+			log.Printf("Warning: %s: unknown config key %q", filename, name)
+		}
+	}
+	return keys, data, nil
+}
+
+// configKeys returns the top-level keys a config file may use.
+func configKeys() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ","); name != "" && name != "-" {
+			keys[name] = true
+		}
+	}
+	return keys
 }
 
-func parseDateTime(value, defaultValue string) time.Time {
-	layout := "2006-01-02T15:04:05Z"
-	if parsed, err := time.Parse(layout, value); err == nil {
-		return parsed
+// yamlKind describes a decoded YAML value for error messages.
+func yamlKind(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "an empty document"
+	case []interface{}:
+		return "a list"
+	case map[interface{}]interface{}:
+		return "a mapping"
+	default:
+		return "a single value"
 	}
-	parsed, _ := time.Parse(layout, defaultValue)
-	return parsed
 }
 
-func castValue(value string, col ColumnConfig) interface{} {
+// prepareConfig validates a loaded config and resolves the references between
+// its sections so rows can be processed without further lookups.
+func prepareConfig(config *Config) error {
+	resolveNullValues(config)
+	if err := resolveComputedColumns(config); err != nil {
+		return err
+	}
+	if err := resolveUnpivot(config); err != nil {
+		return err
+	}
+	if err := resolvePivot(config); err != nil {
+		return err
+	}
+	if err := resolveConditionalDefaults(config); err != nil {
+		return err
+	}
+	if err := resolveLayouts(config); err != nil {
+		return err
+	}
+	if err := resolveReplacements(config); err != nil {
+		return err
+	}
+	if err := resolvePipelines(config); err != nil {
+		return err
+	}
+	if err := validateColumnOptions(config); err != nil {
+		return err
+	}
+	if err := resolveDedup(config); err != nil {
+		return err
+	}
+	if err := resolveCurrencies(config); err != nil {
+		return err
+	}
+	if err := resolveBoolFormats(config); err != nil {
+		return err
+	}
+	if err := resolveControlChars(config); err != nil {
+		return err
+	}
+	if err := resolveRepeatGroups(config); err != nil {
+		return err
+	}
+	return resolveRouting(config)
+}
+
+// isMissing reports whether a raw value is empty or one of the column's null
+// values.
+func isMissing(value string, col ColumnConfig) bool {
 	if value == "" {
-		value = col.Default
+		return true
 	}
+	_, ok := col.nullValues[value]
+	return ok
+}
 
-	switch col.Type {
-	case "int":
-		v, err := strconv.Atoi(value)
-		if err != nil && col.TypePolicy == "strict" {
-			log.Fatalf("Error casting value %s to int for column %s", value, col.Field)
+// resolveNullValues gives every column its set of null values, falling back
+// to the global list.
+func resolveNullValues(config *Config) {
+	for i, col := range config.Columns {
+		values := col.NullValues
+		if values == nil {
+			values = config.NullValues
+		}
+		if len(values) == 0 {
+			continue
+		}
+		config.Columns[i].nullValues = make(map[string]struct{}, len(values))
+		for _, v := range values {
+			config.Columns[i].nullValues[v] = struct{}{}
+		}
+	}
+}
+
+// isEmptyRow reports whether every configured column of row is missing.
+func isEmptyRow(row []string, columns []ColumnConfig) bool {
+	for _, col := range columns {
+		if isComputed(col) {
+			continue
 		}
-		if err != nil && col.TypePolicy == "nullable" {
-			return nil
+		if col.Index < len(row) && !isMissing(row[col.Index], col) {
+			return false
 		}
-		return v
+	}
+	return true
+}
+
+// hasLeadingZeros reports whether a numeric string starts with zeros that a
+// numeric cast would drop, e.g. "00123" or "-007" but not "0" or "0.5".
+func hasLeadingZeros(value string) bool {
+	value = strings.TrimLeft(value, "+-")
+	return len(value) > 1 && value[0] == '0' && value[1] >= '0' && value[1] <= '9'
+}
+
+// checkLeadingZeros returns a warning or, under the strict setting, an error
+// when casting value would drop leading zeros.
+func checkLeadingZeros(value string, col ColumnConfig) (string, error) {
+	if !hasLeadingZeros(value) {
+		return "", nil
+	}
+	switch col.LeadingZeros {
+	case "strict":
+		return "", fmt.Errorf("Error casting value %s to %s for column %s: leading zeros would be lost", value, col.Type, col.Field)
+	case "warn":
+		return fmt.Sprintf("value %s loses leading zeros when cast to %s", value, col.Type), nil
+	}
+	return "", nil
+}
+
+// parseValue converts value to the column's type. On failure it returns the
+// type's zero value along with the error.
+func parseValue(value string, col ColumnConfig) (interface{}, error) {
+	switch col.Type {
+	case "int":
+		return strconv.Atoi(value)
+	case "float":
+		return strconv.ParseFloat(value, 64)
+	case "latitude":
+		return parseCoordinate(value, 90)
+	case "longitude":
+		return parseCoordinate(value, 180)
 	case "bool":
 		v, err := strconv.ParseBool(value)
-		if err != nil && col.TypePolicy == "strict" {
-			log.Fatalf("Error casting value %s to bool for column %s", value, col.Field)
+		if col.BoolFormat != "" && col.BoolFormat != "true/false" {
+			return boolValue{value: v, format: col.BoolFormat}, err
 		}
-		if err != nil && col.TypePolicy == "nullable" {
-			return nil
+		return v, err
+	case "date", "datetime":
+		if col.location != nil {
+			t, err := time.ParseInLocation(col.layout, value, col.location)
+			return t.UTC(), err
 		}
-		return v
-	case "date":
-		return parseDate(value, col.Default)
-	case "datetime":
-		return parseDateTime(value, col.Default)
+		return time.Parse(col.layout, value)
+	case "array":
+		return parseArray(value, col.itemColumn)
+	case "base64decode":
+		return decodeBase64(value)
+	case "base64encode":
+		return base64.StdEncoding.EncodeToString([]byte(value)), nil
+	case "phone":
+		return parsePhone(value, col.Region)
+	case "ip", "ipv4", "ipv6":
+		return parseIP(value, col.Type, col.Normalize)
+	case "enum":
+		return parseEnum(value, col)
+	case "quantity":
+		return parseQuantity(value, col)
+	case "money":
+		amount, err := strconv.ParseFloat(value, 64)
+		return moneyValue{Amount: amount, Currency: col.Currency}, err
+	case "duration":
+		d, err := parseDuration(value)
+		return formatDuration(d, col.DurationFormat), err
 	case "string":
-		return value
+		return value, nil
 	default:
-		return value
+		return value, nil
+	}
+}
+
+// castOutcome records how castValue arrived at a value.
+type castOutcome struct {
+	Defaulted bool   // the default was used
+	Failed    bool   // the value couldn't be converted
+	Warning   string // a problem worth reporting that didn't stop the cast
+}
+
+// castValue converts a raw CSV value according to the column config and
+// reports how it got there. The value goes through the column pipeline first.
+// Empty values use the default; values that can't be converted, or that the
+// pipeline rejects, return an error under the strict policy, become null
+// under nullable, and fall back to the default under flexible.
+func castValue(value string, col ColumnConfig) (interface{}, castOutcome, error) {
+	var outcome castOutcome
+	value, err := cleanControlChars(value, col)
+	if err == nil {
+		value, err = applyPipeline(value, col)
+	}
+	if err == nil && value == "" {
+		value = col.Default
+		outcome.Defaulted = true
+	}
+
+	var warning string
+	if err == nil {
+		value, warning, err = checkLength(value, col, outcome.Defaulted)
+	}
+	var v interface{}
+	if err == nil {
+		v, err = parseValue(value, col)
+	} else if col.TypePolicy == "strict" {
+		return nil, outcome, err
+	}
+	if err != nil {
+		outcome.Failed = true
+		switch col.TypePolicy {
+		case "strict":
+			return nil, outcome, fmt.Errorf("Error casting value %s to %s for column %s", value, col.Type, col.Field)
+		case "nullable":
+			return nil, outcome, nil
+		}
+		outcome.Defaulted = true
+		v, _ = parseValue(col.Default, col)
+		return adjustNumber(v, col), outcome, nil
 	}
+
+	v = adjustNumber(v, col)
+	outcome.Warning = warning
+	if col.Type == "int" || col.Type == "float" {
+		warning, err := checkLeadingZeros(value, col)
+		if err != nil {
+			return nil, outcome, err
+		}
+		if warning != "" {
+			outcome.Warning = warning
+		}
+	}
+	return v, outcome, nil
+}
+
+// options holds the command-line flags of a run.
+type options struct {
+	inputFile          string
+	sheet              string
+	inputFormat        string
+	configFile         string
+	schemaFile         string
+	typesFile          string
+	columnsSpec        string
+	continueOnError    bool
+	maxErrors          int
+	chunkSize          int
+	dedupCount         bool
+	flatten            bool
+	sortSpec           string
+	groupBy            string
+	force              bool
+	perRow             bool
+	perRowKey          string
+	normalizeKeys      string
+	strict             bool
+	nullable           bool
+	validateSchemaFile string
+	validatePolicy     string
+	rejectFile         string
+	warningsFile       string
+	reportFile         string
+	aggregatesFile     string
+	quoteAll           bool
+	sanitizeFormulas   bool
+	keyOrder           string
+	gzipLevel          int
+	protoDescriptor    string
+	protoMessage       string
+	sequential         bool
+	preserveOrder      bool
+	autoWorkers        bool
+	cpuProfile         string
+	memProfile         string
+	pprofAddr          string
+	manifestFile       string
+	bench              int
+	benchRows          int
+	benchData          string
+	benchReport        string
+	seed               seedFlag
+	follow             bool
+	followInterval     time.Duration
+	timeout            time.Duration
+	readBuffer         int
+	countOnly          bool
+	profile            bool
+	emitSchema         bool
+	emitDDL            string
+	emitJSONSchema     bool
+	table              string
+	startOffset        int64
+	endOffset          int64
+	writeBuffer        int
+	inputHeaders       headerFlags
+	configHeaders      headerFlags
+	configOverlays     pathList
+	outputs            outputList
+	constants          keyValueFlags
+
+	// progress receives the progress and summary lines of a run, stdout
+	// unless -bench keeps them apart from its report
+	progress io.Writer
 }
 
 func main() {
-	startTime := time.Now()
+	var opts options
 
 	// Parse command-line flags
-	inputFile := flag.String("input", "", "Input CSV file")
-	configFile := flag.String("config", "", "YAML configuration file")
-	outputFile := flag.String("output", "", "Output JSON file")
+	flag.StringVar(&opts.inputFile, "input", "", "Input CSV or .xlsx file, or http(s) URL")
+	flag.StringVar(&opts.inputFormat, "input-format", "csv", "Input format: csv, tsv (tab), psv (pipe), ssv (semicolon) or ndjson")
+	flag.Int64Var(&opts.startOffset, "start-offset", 0, "Only process records starting at or after this byte offset of the input")
+	flag.Int64Var(&opts.endOffset, "end-offset", 0, "Only process records starting before this byte offset of the input (0 for the end)")
+	flag.StringVar(&opts.sheet, "sheet", "", "Sheet to read from .xlsx input (default: first sheet)")
+	opts.inputHeaders = headerFlags{}
+	flag.Var(opts.inputHeaders, "input-header", "HTTP header sent when -input is a URL, as \"Name: value\"; may be repeated")
+	flag.StringVar(&opts.configFile, "config", "", "YAML configuration file or http(s) URL")
+	opts.configHeaders = headerFlags{}
+	flag.Var(&opts.configOverlays, "config-overlay", "YAML config deep-merged onto -config, e.g. per-environment overrides; may be repeated")
+	flag.Var(opts.configHeaders, "config-header", "HTTP header sent when -config is a URL, as \"Name: value\"; may be repeated")
+	flag.StringVar(&opts.typesFile, "types", "", "YAML library of named column types, defined as a base type with a pattern and pipeline, usable as type: <name>")
+	flag.StringVar(&opts.columnsSpec, "columns", "", "Columns of a headerless input in order, as name:type pairs such as id:int,name,signup:datetime, instead of -config")
+	flag.StringVar(&opts.schemaFile, "schema", "", "JSON Schema used to derive column types")
+	flag.Var(&opts.outputs, "output", "Output file, optionally prefixed with a format (json, ndjson, csv, tsv, arrays, bson, protobuf, rows); may be repeated")
+	opts.constants = keyValueFlags{}
+	flag.Var(opts.constants, "set", "Add a constant key=value field to every record; may be repeated")
+	flag.BoolVar(&opts.continueOnError, "continue-on-error", false, "Skip rows that fail a strict cast instead of aborting")
+	flag.IntVar(&opts.maxErrors, "max-errors", -1, "With -continue-on-error, abort once more than this many rows failed (-1 for no limit)")
+	flag.IntVar(&opts.chunkSize, "chunk-size", 0, "Split each output into numbered files of at most this many rows")
+	flag.BoolVar(&opts.profile, "profile", false, "Write per-column statistics of the raw input to -output instead of converted rows")
+	flag.BoolVar(&opts.emitSchema, "emit-schema", false, "Write the fields, labels, types and nullability of the output records to -output as JSON, without converting any rows")
+	flag.StringVar(&opts.emitDDL, "emit-ddl", "", "Write a CREATE TABLE statement for the output records to -output in this SQL dialect: postgres, mysql or sqlite")
+	flag.BoolVar(&opts.emitJSONSchema, "emit-json-schema", false, "Write a JSON Schema document describing the output records to -output, without converting any rows")
+	flag.StringVar(&opts.table, "table", "", "Table name of -emit-ddl")
+	flag.BoolVar(&opts.countOnly, "count-only", false, "Only count rows (and unique rows with ignore_duplicates), without casting or writing output")
+	flag.BoolVar(&opts.dedupCount, "dedup-count", false, "Only count unique and duplicate rows, without writing output")
+	flag.BoolVar(&opts.flatten, "flatten", false, "Flatten nested values such as arrays into dotted keys when writing")
+	flag.StringVar(&opts.sortSpec, "sort", "", "Sort output by comma-separated fields, each optionally suffixed with :asc or :desc")
+	flag.StringVar(&opts.groupBy, "group-by", "", "Write JSON output as an object of record arrays keyed by these comma-separated fields")
+	flag.BoolVar(&opts.force, "force", false, "Overwrite output files that already exist")
+	flag.BoolVar(&opts.perRow, "per-row", false, "Write each row to its own JSON file in the -output directory")
+	flag.StringVar(&opts.perRowKey, "per-row-key", "", "Column label used to name per-row files (default: row number)")
+	flag.StringVar(&opts.normalizeKeys, "normalize-keys", "", "Rewrite output keys as snake, camel or lower case")
+	flag.BoolVar(&opts.strict, "strict", false, "Treat every column as type_policy: strict")
+	flag.BoolVar(&opts.nullable, "nullable", false, "Treat every column as type_policy: nullable")
+	flag.StringVar(&opts.validateSchemaFile, "validate-schema", "", "JSON Schema every output record must conform to")
+	flag.StringVar(&opts.validatePolicy, "validate-policy", "abort", "What to do with records that fail -validate-schema: abort, reject or warn")
+	flag.StringVar(&opts.rejectFile, "reject-file", "", "With -validate-policy reject, write rejected records to this NDJSON file")
+	flag.StringVar(&opts.warningsFile, "warnings", "", "Collect row warnings into this JSON file instead of logging them")
+	flag.StringVar(&opts.reportFile, "report", "", "Write a per-column data quality report to this JSON file")
+	flag.StringVar(&opts.aggregatesFile, "aggregates", "", "Write the aggregates of columns with aggregate set to this JSON file")
+	flag.BoolVar(&opts.quoteAll, "quote-all", false, "Quote every field in CSV output")
+	flag.StringVar(&opts.keyOrder, "key-order", "sorted", "Order of keys in JSON output: sorted (byte order), alpha (ignoring case) or config (column order)")
+	flag.IntVar(&opts.gzipLevel, "gzip-level", gzip.DefaultCompression, "Compression level of .gz outputs, from 1 (fastest) to 9 (smallest), 0 for none, or -1 for the compress/gzip default")
+	flag.StringVar(&opts.protoDescriptor, "proto-descriptor", "", "FileDescriptorSet (protoc --include_imports --descriptor_set_out) of the message protobuf outputs are written as")
+	flag.StringVar(&opts.protoMessage, "proto-message", "", "Full name of the -proto-descriptor message to write, such as hr.Employee; optional when it defines only one")
+	flag.BoolVar(&opts.sanitizeFormulas, "sanitize-formulas", false, "Prefix CSV text cells starting with =, +, -, @ with an apostrophe to prevent formula injection")
+	flag.BoolVar(&opts.sequential, "sequential", false, "Process rows one at a time in input order, without goroutines")
+	flag.BoolVar(&opts.preserveOrder, "preserve-order", false, "Process rows concurrently but write them in input order, keeping the first of any duplicates")
+	flag.BoolVar(&opts.autoWorkers, "auto-workers", false, "Process rows on a worker pool that grows while throughput improves, instead of one goroutine per row")
+	flag.StringVar(&opts.cpuProfile, "cpuprofile", "", "Write a CPU profile to this file")
+	flag.StringVar(&opts.memProfile, "memprofile", "", "Write a heap profile to this file when done")
+	flag.StringVar(&opts.pprofAddr, "pprof-addr", "", "Serve net/http/pprof on this address, e.g. localhost:6060")
+	flag.BoolVar(&opts.follow, "follow", false, "Keep reading the input as it grows, like tail -f, streaming new records to ndjson outputs until interrupted")
+	flag.DurationVar(&opts.followInterval, "follow-interval", time.Second, "How often -follow checks the input for new data")
+	flag.DurationVar(&opts.timeout, "timeout", 0, "Stop the run after this long, such as 30s or 5m, writing partial output and exiting with an error (0 for no limit)")
+	flag.IntVar(&opts.readBuffer, "read-buffer", 1<<20, "Size in bytes of the input read buffer")
+	flag.IntVar(&opts.writeBuffer, "write-buffer", 1<<20, "Size in bytes of the write buffer of each output file")
+	flag.IntVar(&opts.bench, "bench", 0, "Convert a generated dataset this many times and report the latency and throughput as JSON, instead of converting -input")
+	flag.IntVar(&opts.benchRows, "bench-rows", 100000, "Number of rows of the -bench dataset")
+	flag.StringVar(&opts.benchData, "bench-data", "", "Keep the -bench dataset at this path, e.g. to run main.py on the same rows")
+	flag.StringVar(&opts.benchReport, "bench-report", "", "Write the -bench report to this file instead of stdout")
+	flag.Var(&opts.seed, "seed", "Seed of the generated -bench dataset (1 when unset)")
+	flag.StringVar(&opts.manifestFile, "manifest", "", "YAML list of {input, sheet, config, schema, output} jobs to run in turn")
 	flag.Parse()
 
-	if *inputFile == "" || *configFile == "" || *outputFile == "" {
-		log.Fatal("Input file, config file, and output file are required")
+	if opts.cpuProfile != "" {
+		stop, err := startCPUProfile(opts.cpuProfile)
+		if err != nil {
+			log.Fatalf("Failed to start CPU profile: %v", err)
+		}
+		defer stop()
+	}
+	if opts.pprofAddr != "" {
+		servePprof(opts.pprofAddr)
 	}
 
-	// Load YAML configuration
-	config, err := loadConfig(*configFile)
-	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+	if opts.bench > 0 {
+		if opts.inputFile != "" || opts.manifestFile != "" || opts.benchRows < 1 {
+			log.Fatal("-bench generates its own input and can't be combined with -input or -manifest, and -bench-rows must be positive")
+		}
+		if err := runBenchmark(opts); err != nil {
+			log.Fatalf("Benchmark failed: %v", err)
+		}
+	} else if opts.manifestFile == "" {
+		run(opts)
+	} else {
+		jobs, err := loadManifest(opts.manifestFile)
+		if err != nil {
+			log.Fatalf("Failed to load manifest: %v", err)
+		}
+		for i, job := range jobs {
+			fmt.Printf("Job %d of %d: %s\n", i+1, len(jobs), job.Input)
+			run(job.apply(opts))
+		}
 	}
 
-	// Open the CSV file
-	file, err := os.Open(*inputFile)
+	if opts.memProfile != "" {
+		if err := writeMemProfile(opts.memProfile); err != nil {
+			log.Fatalf("Failed to write heap profile: %v", err)
+		}
+	}
+}
+
+// run converts one input according to opts.
+func run(opts options) {
+	startTime := time.Now()
+	if opts.progress == nil {
+		opts.progress = os.Stdout
+	}
+	deadline := startDeadline(opts.timeout)
+	defer deadline.stop()
+
+	if opts.inputFile == "" || (opts.configFile == "" && opts.schemaFile == "" && opts.columnsSpec == "") {
+		log.Fatal("Input file, config file (or schema), and output file are required")
+	}
+	if opts.columnsSpec != "" && (opts.configFile != "" || opts.schemaFile != "") {
+		log.Fatal("-columns can't be combined with -config or -schema")
+	}
+	if _, delimited := inputDelimiters[opts.inputFormat]; !delimited && opts.inputFormat != "ndjson" {
+		log.Fatalf("Unknown -input-format %q (use csv, tsv, psv, ssv or ndjson)", opts.inputFormat)
+	}
+	if opts.strict && opts.nullable {
+		log.Fatal("-strict and -nullable can't be combined")
+	}
+	if opts.autoWorkers && (opts.sequential || opts.follow) {
+		log.Fatal("-auto-workers can't be combined with -sequential or -follow")
+	}
+	if opts.gzipLevel < gzip.DefaultCompression || opts.gzipLevel > gzip.BestCompression {
+		log.Fatalf("Invalid -gzip-level %d (use -1 to 9)", opts.gzipLevel)
+	}
+	if len(opts.configOverlays) > 0 && opts.configFile == "" {
+		log.Fatal("-config-overlay needs a base -config")
+	}
+	if opts.emitDDL != "" {
+		if ddlTypes[opts.emitDDL] == nil {
+			log.Fatalf("Unknown -emit-ddl %q (use postgres, mysql or sqlite)", opts.emitDDL)
+		}
+		if opts.table == "" {
+			log.Fatal("-emit-ddl requires -table")
+		}
+	}
+	if !keyOrders[opts.keyOrder] {
+		log.Fatalf("Unknown -key-order %q (use sorted, alpha or config)", opts.keyOrder)
+	}
+	switch opts.validatePolicy {
+	case "abort", "warn":
+	case "reject":
+		if opts.rejectFile == "" {
+			log.Fatal("-validate-policy reject requires -reject-file")
+		}
+	default:
+		log.Fatalf("Unknown -validate-policy %q (use abort, reject or warn)", opts.validatePolicy)
+	}
+	if opts.perRow {
+		opts.outputs.resolveFormats("rows")
+	} else {
+		opts.outputs.resolveFormats("json")
+	}
+	if !opts.force {
+		if err := opts.outputs.checkClobber(opts.chunkSize > 0); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Load YAML configuration. A schema on its own implies a header row that
+	// names the columns.
+	config := &Config{Header: true}
+	var err error
+	if opts.configFile != "" {
+		config, err = loadConfig(opts.configFile, http.Header(opts.configHeaders), opts.configOverlays)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+	if opts.columnsSpec != "" {
+		columns, err := parseColumnsFlag(opts.columnsSpec)
+		if err != nil {
+			log.Fatalf("Invalid -columns: %v", err)
+		}
+		config = &Config{Columns: columns}
+	}
+	if len(opts.outputs) == 0 && !opts.dedupCount && !opts.countOnly && config.Routing == nil {
+		log.Fatal("Input file, config file (or schema), and output file are required")
+	}
+	if config.HeaderRows > 1 && (opts.inputFormat == "ndjson" || opts.follow || opts.startOffset > 0 || opts.endOffset > 0) {
+		log.Fatal("header_rows needs CSV or .xlsx input, without -follow, -start-offset or -end-offset")
+	}
+	config.comma = inputDelimiters[opts.inputFormat]
+	if config.comma != 0 && config.QuoteChar == string(config.comma) {
+		log.Fatalf("quote_char %q can't be the field delimiter of -input-format %s", config.QuoteChar, opts.inputFormat)
+	}
+	if opts.typesFile != "" {
+		config.typeLibrary, err = loadTypeLibrary(opts.typesFile)
+		if err != nil {
+			log.Fatalf("Failed to load types: %v", err)
+		}
+	}
+	var schema *jsonSchema
+	if opts.schemaFile != "" {
+		schema, err = loadJSONSchema(opts.schemaFile)
+		if err != nil {
+			log.Fatalf("Failed to load schema: %v", err)
+		}
+	}
+	var contract *contractSchema
+	if opts.validateSchemaFile != "" {
+		contract, err = loadContractSchema(opts.validateSchemaFile)
+		if err != nil {
+			log.Fatalf("Failed to load validation schema: %v", err)
+		}
+	}
+	var protoMessage protoreflect.MessageDescriptor
+	if opts.protoDescriptor != "" {
+		protoMessage, err = loadProtoMessage(opts.protoDescriptor, opts.protoMessage)
+		if err != nil {
+			log.Fatalf("Failed to load proto descriptor: %v", err)
+		}
+	}
+	for _, target := range opts.outputs {
+		if target.Format == "protobuf" && protoMessage == nil {
+			log.Fatalf("protobuf output %s requires -proto-descriptor", target.Path)
+		}
+	}
+
+	// Open the input file
+	file, err := openInput(deadline.ctx, opts.inputFile, http.Header(opts.inputHeaders))
 	if err != nil {
-		log.Fatal("Unable to open CSV file", err)
+		log.Fatal("Unable to open input file: ", err)
 	}
 	defer file.Close()
 
-	fmt.Printf("Time to open file: %v\n", time.Since(startTime))
+	fmt.Fprintf(opts.progress, "Time to open file: %v\n", time.Since(startTime))
+	var source io.Reader = file
+	if opts.startOffset > 0 || opts.endOffset > 0 {
+		if err := checkShard(opts); err != nil {
+			log.Fatal(err)
+		}
+		header := config.Header && opts.inputFormat != "ndjson"
+		source, err = shardReader(file.(io.ReadSeeker), opts.startOffset, opts.endOffset, header)
+		if err != nil {
+			log.Fatal("Unable to read input file: ", err)
+		}
+	}
+	if opts.timeout > 0 && !opts.follow {
+		// Followed input stops at the deadline through the interrupt flag
+		source = deadlineReader{r: source, deadline: deadline}
+	}
+	input := bufio.NewReaderSize(source, opts.readBuffer)
 
-	// Read the CSV file
-	reader := csv.NewReader(file)
+	// The schema of plain CSV only depends on the header and the first record
+	if (opts.emitSchema || opts.emitDDL != "" || opts.emitJSONSchema) && config.HeaderRows <= 1 && config.QuoteChar == "" && !opts.follow && opts.inputFormat != "ndjson" && !isXLSX(opts.inputFile) {
+		header, width, err := peekCSV(input, config)
+		if err != nil {
+			log.Fatal("Unable to read input file: ", err)
+		}
+		if err := resolveColumns(config, schema, header, width, opts); err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+		emitSchema(opts, config, startTime)
+		return
+	}
 
-	// Skip the header if config says so
-	if config.Header {
-		_, _ = reader.Read()
+	// Counting plain CSV only needs one record at a time
+	if opts.countOnly && !opts.follow && opts.inputFormat != "ndjson" && config.SkipTrailingRows == 0 && config.HeaderRows <= 1 && !isXLSX(opts.inputFile) && !config.PreserveQuotedEmpty && config.QuoteChar == "" {
+		total, unique, err := countCSV(input, config, func(header []string, width int) error {
+			return resolveColumns(config, schema, header, width, opts)
+		})
+		if err != nil {
+			log.Fatal("Unable to read input file: ", err)
+		}
+		printCounts(opts.progress, config, total, unique, startTime)
+		return
 	}
 
-	records, err := reader.ReadAll()
+	// Read the whole input, splitting off the header if config says so
+	var header []string
+	var records [][]string
+	var quotedEmpty [][]bool
+	var follower *followReader
+	var followed *csv.Reader
+	switch {
+	case opts.follow:
+		follower = &followReader{r: input, interval: opts.followInterval}
+		header, followed, err = followCSV(follower, config)
+	case opts.inputFormat == "ndjson":
+		header, records, err = readNDJSON(input, config)
+	case isXLSX(opts.inputFile):
+		header, records, err = readXLSX(input, opts.sheet, config.Header)
+	case config.PreserveQuotedEmpty || config.QuoteChar != "":
+		header, records, quotedEmpty, err = readQuoteAwareCSV(input, config)
+		if !config.PreserveQuotedEmpty {
+			quotedEmpty = nil
+		}
+	default:
+		header, records, err = readCSV(input, config)
+	}
 	if err != nil {
-		log.Fatal("Unable to read CSV file", err)
+		log.Fatal("Unable to read input file: ", err)
+	}
+	// The rows after the first header row are read as records, so they are
+	// merged into it here
+	if n := config.HeaderRows - 1; n > 0 && header != nil {
+		n = min(n, len(records))
+		header = mergeHeaderRows(append([][]string{header}, records[:n]...), config.HeaderSeparator)
+		records = records[n:]
+		if quotedEmpty != nil {
+			quotedEmpty = quotedEmpty[n:]
+		}
+	}
+	// Footer rows are only at the end of the file, not of a shard before it
+	if n := config.SkipTrailingRows; n > 0 && opts.endOffset == 0 {
+		n = min(n, len(records))
+		records = records[:len(records)-n]
+		if quotedEmpty != nil {
+			quotedEmpty = quotedEmpty[:len(records)]
+		}
+		fmt.Fprintf(opts.progress, "Skipped %d trailing rows\n", n)
+	}
+
+	fmt.Fprintf(opts.progress, "Time to read file: %v\n", time.Since(startTime))
+
+	// Resolve the columns now that the header and width of the file are known
+	width := len(header)
+	if width == 0 && len(records) > 0 {
+		width = len(records[0])
+	}
+	if err := resolveColumns(config, schema, header, width, opts); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	var sortKeys []sortKey
+	if opts.sortSpec != "" {
+		sortKeys, err = parseSortKeys(opts.sortSpec, config)
+		if err != nil {
+			log.Fatalf("Invalid -sort: %v", err)
+		}
+	}
+
+	var groupBy []string
+	if opts.groupBy != "" {
+		groupBy, err = parseGroupBy(opts, config)
+		if err != nil {
+			log.Fatalf("Invalid -group-by: %v", err)
+		}
+	}
+
+	if opts.follow {
+		if err := checkFollow(opts, config); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.Routing != nil && !opts.force {
+		if err := config.Routing.targets().checkClobber(opts.chunkSize > 0); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	fmt.Printf("Time to read file: %v\n", time.Since(startTime))
+	if opts.emitSchema || opts.emitDDL != "" || opts.emitJSONSchema {
+		emitSchema(opts, config, startTime)
+		return
+	}
+	if opts.profile {
+		profiles := profileColumns(records, config.Columns)
+		for _, target := range opts.outputs {
+			if err := writeProfile(target.Path, len(records), profiles); err != nil {
+				log.Fatalf("Failed to write profile: %v", err)
+			}
+		}
+		fmt.Fprintf(opts.progress, "Profiled %d rows and %d columns in %.2f seconds\n", len(records), len(profiles), time.Since(startTime).Seconds())
+		return
+	}
+	if opts.countOnly {
+		unique := len(records)
+		if config.IgnoreDuplicates {
+			unique, _ = countDuplicates(records, config.dedupColumns)
+		}
+		printCounts(opts.progress, config, len(records), unique, startTime)
+		return
+	}
+	if opts.dedupCount {
+		unique, duplicates := countDuplicates(records, config.dedupColumns)
+		fmt.Fprintf(opts.progress, "Counted %d rows in %.2f seconds\n", len(records), time.Since(startTime).Seconds())
+		fmt.Fprintf(opts.progress, "Found %d unique rows\n", unique)
+		fmt.Fprintf(opts.progress, "Found %d duplicate rows\n", duplicates)
+		for _, key := range config.DedupKeys {
+			unique, duplicates := countDuplicates(records, key.columns)
+			fmt.Fprintf(opts.progress, "Dedup key %s: %d unique, %d duplicate values\n", key.Name, unique, duplicates)
+		}
+		return
+	}
 
 	var jsonData []map[string]interface{}
 	var wg sync.WaitGroup
 	jsonDataMutex := &sync.Mutex{}
-	seenMutex := &sync.Mutex{}
+
+	// The report also counts nulls for max_null_rate
+	var report *qualityReport
+	if opts.reportFile != "" || hasNullRates(config) {
+		report = newQualityReport(config.Columns)
+	}
+
+	warnings := &warningLog{collect: opts.warningsFile != ""}
+	headerLines := 0
+	if config.Header {
+		headerLines = max(config.HeaderRows, 1)
+	}
+	// lineOf maps a record index to its line number in the file, assuming one
+	// line per record
+	lineOf := func(i int) int { return i + 1 + headerLines }
+
+	rejects := &rejectLog{}
 
 	// Track seen rows to avoid duplicates
-	seen := make(map[string]struct{})
-	var processedCount, ignoredCount int
+	seen := newDedupSet()
+	// With -preserve-order, workers hand their records to a collector that
+	// restores input order, and duplicates are dropped there
+	var ordered chan indexedRecord
+	var collected <-chan []indexedRecord
+	if opts.preserveOrder && !opts.sequential && !opts.follow {
+		ordered = make(chan indexedRecord, 1024)
+		collected = collectRecords(ordered)
+	}
+	var keeper *dedupKeeper
+	if config.dedupKeep != nil || config.DedupMode == "count" {
+		countKey := ""
+		if config.DedupMode == "count" {
+			countKey = config.DedupCountKey
+		}
+		keeper = newDedupKeeper(config.dedupKeep, countKey)
+	}
+	var processedCount, emptyCount, errorCount int
 
-	// Process rows concurrently
-	for i, row := range records {
-		wg.Add(1)
-		go func(i int, row []string) {
-			defer wg.Done()
+	// failRow aborts on a row error, or counts and skips the row when
+	// continuing on errors until more than maxErrors have been seen
+	failRow := func(i int, err error) {
+		if !opts.continueOnError {
+			log.Fatal(err)
+		}
+		jsonDataMutex.Lock()
+		defer jsonDataMutex.Unlock()
+		errorCount++
+		warnings.addf(lineOf(i), "", "skipping row: %v", err)
+		if opts.maxErrors >= 0 && errorCount > opts.maxErrors {
+			log.Fatalf("Aborting after %d errors, %d of %d rows processed", errorCount, processedCount, len(records))
+		}
+	}
+
+	var stream *ndjsonStream
+	if opts.follow {
+		stream, err = openNDJSONStream(opts.outputs, outputOptions{Labels: columnLabels(config), KeyOrder: opts.keyOrder, GzipLevel: opts.gzipLevel})
+		if err != nil {
+			log.Fatal("Unable to write output: ", err)
+		}
+	}
+	aggregates := newAggregator(config.Columns)
+	// streamed counts the records written to a followed stream, which with
+	// unpivot can be several per row
+	streamed := 0
+	appendRecord := func(entry map[string]interface{}) {
+		if stream != nil {
+			// Followed rows are processed one at a time, so no lock is needed
+			aggregates.add(entry)
+			records := []map[string]interface{}{entry}
+			if config.Unpivot != nil {
+				records = unpivot(entry, config.Unpivot)
+			}
+			for _, record := range records {
+				if config.RowNumberKey != "" {
+					record[config.RowNumberKey] = config.rowNumberStart() + streamed
+				}
+				if err := stream.write(record); err != nil {
+					log.Fatal("Unable to write output: ", err)
+				}
+				streamed++
+			}
+			processedCount++
+			return
+		}
+		jsonDataMutex.Lock()
+		aggregates.add(entry)
+		if config.Unpivot != nil {
+			jsonData = append(jsonData, unpivot(entry, config.Unpivot)...)
+		} else {
+			jsonData = append(jsonData, entry)
+		}
+		processedCount++
+		jsonDataMutex.Unlock()
+	}
+
+	var tracker dedupTracker
+	if len(config.DedupKeys) > 0 {
+		tracker = newDedupTracker(config)
+	}
+	interrupt := watchInterrupts(deadline)
+	processRow := func(i int, row []string) {
+		if interrupt.interrupted() {
+			return
+		}
+		if config.SkipEmptyRows && isEmptyRow(row, config.Columns) {
+			jsonDataMutex.Lock()
+			emptyCount++
+			jsonDataMutex.Unlock()
+			return
+		}
 
+		// Check for duplicates
+		var uniqueKey string
+		if tracker != nil {
+			tracker.add(row, config)
+		}
+		if config.IgnoreDuplicates {
 			// Create a unique key for the current row based on relevant fields
-			uniqueKey := ""
-			for _, col := range config.Columns {
-				if config.IgnoreDuplicates {
-					if col.Index < len(row) {
-						uniqueKey += row[col.Index] + "|"
+			uniqueKey = rowKey(row, config.dedupColumns)
+			if keeper == nil && ordered == nil && !seen.add(uniqueKey) {
+				return // Skip processing this row
+			}
+		}
+
+		entry := make(map[string]interface{})
+		// With annotate_errors the problems of the row are kept in the record,
+		// and cast errors don't abort the run
+		var problems []interface{}
+		annotate := func(field, message string) {
+			problems = append(problems, map[string]interface{}{"field": field, "message": message})
+		}
+		for _, col := range config.Columns {
+			if col.Type == "hash" {
+				entry[col.Label] = hashValue(row, col)
+				continue
+			}
+			if len(col.Repeat) > 0 {
+				value, err := repeatValue(row, col, func(field, message string) {
+					warnings.add(lineOf(i), field, message)
+					if config.AnnotateErrors {
+						annotate(field, message)
 					}
+				})
+				if err != nil && config.AnnotateErrors {
+					annotate(col.Field, err.Error())
+					entry[col.Label] = nil
+					continue
 				}
+				if err != nil {
+					failRow(i, err)
+					return
+				}
+				entry[col.Label] = value
+				continue
 			}
-
-			// Check for duplicates
-			if config.IgnoreDuplicates {
-				seenMutex.Lock()
-				if _, exists := seen[uniqueKey]; exists {
-					ignoredCount++
-					seenMutex.Unlock()
-					return // Skip processing this row
+			// Ensure the column index is within the bounds of the row
+			if col.Index < len(row) {
+				raw := row[col.Index]
+				if raw == "" && col.QuotedEmpty != "" && col.QuotedEmpty != "missing" &&
+					i < len(quotedEmpty) && col.Index < len(quotedEmpty[i]) && quotedEmpty[i][col.Index] {
+					// An explicit "" skips defaults entirely
+					if col.QuotedEmpty == "empty" {
+						entry[col.Label] = ""
+					} else {
+						entry[col.Label] = nil
+					}
+					if report != nil {
+						report.record(col.Label, entry[col.Label], castOutcome{})
+					}
+					continue
+				}
+				if col.TrimChars != "" {
+					raw = strings.Trim(raw, col.TrimChars)
+				}
+				raw = applyReplacements(raw, col)
+				conditional := false
+				if isMissing(raw, col) {
+					raw = ""
+					raw, conditional = conditionalDefault(row, col)
+				}
+				value, outcome, err := castValue(raw, col)
+				if err != nil && config.AnnotateErrors {
+					annotate(col.Field, err.Error())
+					value, outcome = nil, castOutcome{Failed: true}
+				} else if err != nil {
+					failRow(i, err)
+					return
+				}
+				if outcome.Warning != "" {
+					warnings.add(lineOf(i), col.Field, outcome.Warning)
+				}
+				if config.AnnotateErrors {
+					switch {
+					case err != nil:
+					case outcome.Failed && value == nil:
+						annotate(col.Field, fmt.Sprintf("can't cast %q to %s, using null", raw, col.Type))
+					case outcome.Failed:
+						annotate(col.Field, fmt.Sprintf("can't cast %q to %s, using the default", raw, col.Type))
+					case outcome.Warning != "":
+						annotate(col.Field, outcome.Warning)
+					}
+				}
+				if col.CurrencyField != "" {
+					value = withCurrency(value, row, col)
+				}
+				if report != nil {
+					outcome.Defaulted = outcome.Defaulted || conditional
+					report.record(col.Label, value, outcome)
+				}
+				entry[col.Label] = value
+			} else {
+				warnings.addf(lineOf(i), col.Field, "column index %d out of range", col.Index)
+				if config.AnnotateErrors {
+					annotate(col.Field, fmt.Sprintf("column index %d out of range", col.Index))
+				}
+				// The column is left out of the record, which counts as null
+				// for the report and max_null_rate
+				if report != nil {
+					report.record(col.Label, nil, castOutcome{})
 				}
-				seen[uniqueKey] = struct{}{} // Mark this row as seen
-				seenMutex.Unlock()
 			}
+		}
 
-			entry := make(map[string]interface{})
-			for _, col := range config.Columns {
-				// Ensure the column index is within the bounds of the row
-				if col.Index < len(row) {
-					value := castValue(row[col.Index], col)
-					entry[col.Label] = value
-				} else {
-					log.Printf("Warning: Column index %d out of range for row %d", col.Index, i)
+		for key, value := range config.Constants {
+			entry[key] = value
+		}
+		if config.MetaLineKey != "" {
+			entry[config.MetaLineKey] = lineOf(i)
+		}
+		if config.MetaFileKey != "" {
+			entry[config.MetaFileKey] = opts.inputFile
+		}
+
+		if contract != nil {
+			errs, err := contract.validateRecord(entry)
+			if err != nil {
+				failRow(i, err)
+				return
+			}
+			if config.AnnotateErrors {
+				for _, e := range errs {
+					annotate("", "schema violation: "+e)
 				}
 			}
+			if len(errs) > 0 {
+				switch {
+				case opts.validatePolicy == "warn":
+					for _, e := range errs {
+						warnings.addf(lineOf(i), "", "schema violation: %s", e)
+					}
+				case opts.validatePolicy == "reject":
+					rejects.add(lineOf(i), errs, entry)
+					return
+				case !config.AnnotateErrors:
+					log.Fatalf("Line %d does not match the validation schema: %s", lineOf(i), strings.Join(errs, "; "))
+				}
+			}
+		}
+		if config.AnnotateErrors {
+			if problems == nil {
+				problems = []interface{}{}
+			}
+			entry[errorsKey] = problems
+		}
 
-			jsonDataMutex.Lock()
-			jsonData = append(jsonData, entry)
-			processedCount++
-			jsonDataMutex.Unlock()
-		}(i, row)
+		if keeper != nil {
+			// The record is appended once every row of its group is seen
+			keeper.offer(uniqueKey, i, entry)
+			return
+		}
+		if ordered != nil {
+			ordered <- indexedRecord{index: i, key: uniqueKey, entry: entry}
+			return
+		}
+		appendRecord(entry)
+	}
+
+	rowCount := len(records)
+	switch {
+	case opts.follow:
+		// Stream rows as they are appended until interrupted
+		follower.stop = interrupt.interrupted
+		for i := 0; ; i++ {
+			row, err := followed.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatal("Unable to read input file: ", err)
+			}
+			processRow(i, row)
+			rowCount++
+		}
+		if err := stream.close(); err != nil {
+			log.Fatal("Unable to write output: ", err)
+		}
+	case opts.sequential:
+		// Process rows in order so the output is deterministic
+		for i, row := range records {
+			processRow(i, row)
+		}
+	case opts.autoWorkers:
+		workers := processAdaptively(len(records), func(i int) {
+			processRow(i, records[i])
+		})
+		fmt.Fprintf(opts.progress, "Settled on %d workers\n", workers)
+	default:
+		// Process rows concurrently
+		for i, row := range records {
+			wg.Add(1)
+			go func(i int, row []string) {
+				defer wg.Done()
+				processRow(i, row)
+			}(i, row)
+		}
+		wg.Wait()
+	}
+	if ordered != nil {
+		close(ordered)
+		for _, entry := range compactRecords(<-collected, seen, config.IgnoreDuplicates) {
+			appendRecord(entry)
+		}
 	}
 
-	wg.Wait()
+	interrupt.done()
+	if keeper != nil {
+		for _, entry := range keeper.records() {
+			appendRecord(entry)
+		}
+	}
+	if deadline.passed() {
+		fmt.Fprintf(opts.progress, "Timed out after processing %d of %d rows\n", processedCount, rowCount)
+	} else if interrupt.interrupted() {
+		fmt.Fprintf(opts.progress, "Interrupted after processing %d of %d rows\n", processedCount, rowCount)
+	}
 
-	// Convert to JSON
-	jsonPayload, err := json.MarshalIndent(jsonData, "", "  ")
-	if err != nil {
-		log.Fatal("Unable to marshal to JSON", err)
+	// Pivoting needs every row, so it runs once processing is done
+	if config.Pivot != nil {
+		jsonData = pivot(jsonData, config.Pivot)
+	}
+	if sortKeys != nil {
+		sortRecords(jsonData, sortKeys)
+	}
+	// Rows are numbered once their final order is known
+	if config.RowNumberKey != "" {
+		numberRecords(jsonData, config.RowNumberKey, config.rowNumberStart())
 	}
 
-	// Write JSON to output file
-	err = os.WriteFile(*outputFile, jsonPayload, 0644)
-	if err != nil {
-		log.Fatal("Unable to write JSON to file", err)
+	// Records are routed before flattening, which may rename their keys
+	var routed []routedRecords
+	if config.Routing != nil {
+		routed = routeRecords(jsonData, config.Routing)
+	}
+	labels := columnLabels(config)
+	if opts.flatten {
+		jsonData, labels = flattenRecords(jsonData, labels)
+	}
+	writeOpts := outputOptions{
+		PerRowKey:        opts.perRowKey,
+		Labels:           labels,
+		QuoteAll:         opts.quoteAll,
+		ChunkSize:        opts.chunkSize,
+		SanitizeFormulas: opts.sanitizeFormulas,
+		GroupBy:          groupBy,
+		WriteBuffer:      opts.writeBuffer,
+		KeyOrder:         opts.keyOrder,
+		GzipLevel:        opts.gzipLevel,
+		ProtoMessage:     protoMessage,
+	}
+	if !opts.follow {
+		if err := writeOutputs(opts.outputs, jsonData, writeOpts); err != nil {
+			log.Fatal("Unable to write output: ", err)
+		}
+		for _, part := range routed {
+			records, partOpts := part.records, writeOpts
+			if opts.flatten {
+				records, partOpts.Labels = flattenRecords(records, columnLabels(config))
+			}
+			if err := writeOutputs(outputList{part.target}, records, partOpts); err != nil {
+				log.Fatal("Unable to write output: ", err)
+			}
+			fmt.Fprintf(opts.progress, "Routed %d rows to %s\n", len(part.records), part.target.Path)
+		}
+	}
+
+	if warnings.collect {
+		if err := warnings.write(opts.warningsFile); err != nil {
+			log.Fatalf("Failed to write warnings: %v", err)
+		}
+	}
+
+	if opts.validatePolicy == "reject" {
+		if err := rejects.write(opts.rejectFile); err != nil {
+			log.Fatalf("Failed to write rejected records: %v", err)
+		}
+	}
+
+	if opts.reportFile != "" {
+		if err := report.write(opts.reportFile); err != nil {
+			log.Fatalf("Failed to write report: %v", err)
+		}
+	}
+
+	if opts.aggregatesFile != "" {
+		if err := aggregates.write(opts.aggregatesFile); err != nil {
+			log.Fatalf("Failed to write aggregates: %v", err)
+		}
 	}
 
 	totalTime := time.Since(startTime)
-	rowCount := len(records)
 	avgSpeed := float64(processedCount) / totalTime.Seconds()
 
-	fmt.Printf("Processed %d rows in %.2f seconds\n", rowCount, totalTime.Seconds())
+	fmt.Fprintf(opts.progress, "Processed %d rows in %.2f seconds\n", rowCount, totalTime.Seconds())
 	if config.IgnoreDuplicates {
-		fmt.Printf("Ignored %d duplicate rows\n", ignoredCount)
-		fmt.Printf("Found %d unique rows\n", processedCount)
+		ignored := seen.ignoredCount()
+		if keeper != nil {
+			ignored = keeper.ignoredCount()
+		}
+		fmt.Fprintf(opts.progress, "Ignored %d duplicate rows\n", ignored)
+		fmt.Fprintf(opts.progress, "Found %d unique rows\n", processedCount)
+	}
+	tracker.print(opts.progress, config)
+	if config.SkipEmptyRows {
+		fmt.Fprintf(opts.progress, "Skipped %d empty rows\n", emptyCount)
+	}
+	if opts.continueOnError {
+		fmt.Fprintf(opts.progress, "Skipped %d rows with errors\n", errorCount)
+	}
+	if opts.validatePolicy == "reject" {
+		fmt.Fprintf(opts.progress, "Rejected %d rows failing the validation schema\n", len(rejects.records))
+	}
+	aggregates.print(opts.progress)
+	fmt.Fprintf(opts.progress, "Average processing speed: %.2f rows/second\n", avgSpeed)
+	if report != nil {
+		problems := report.nullRateProblems()
+		for _, problem := range problems {
+			log.Printf("Warning: %s", problem)
+		}
+		if len(problems) > 0 && config.NullRatePolicy != "warn" {
+			log.Fatal("Aborting: max_null_rate exceeded")
+		}
+	}
+	if deadline.passed() {
+		log.Fatalf("Aborting: %v", deadline.err())
+	}
+	if interrupt.interrupted() {
+		os.Exit(130)
+	}
+}
+
+// resolveColumns completes the config once the header and the width of the
+// input are known: aliases and schema types, header-only configs, expanded
+// ranges and wildcards, the types map, key normalization and policy
+// overrides, and finally prepareConfig, constants and metadata keys.
+func resolveColumns(config *Config, schema *jsonSchema, header []string, width int, opts options) error {
+	// Use the header to resolve column aliases and schema properties
+	if config.Header {
+		resolveAliases(config, header)
+	}
+	if schema != nil {
+		applySchema(config, schema, header)
+	}
+
+	// A header with no columns configured passes every column through as a
+	// string named after its header
+	if len(config.Columns) == 0 && config.Header {
+		config.Columns = []ColumnConfig{{wildcard: true}}
+	}
+
+	if err := expandColumns(config, header, width); err != nil {
+		return err
+	}
+	if err := applyTypes(config); err != nil {
+		return err
+	}
+	applyTypeLibrary(config.Columns, config.typeLibrary)
+	var problems []string
+	if config.Header {
+		problems = checkHeader(config, header)
+	} else if width > 0 {
+		problems = checkWidth(config, width)
+	}
+	// Without a header nothing else can vouch for the indexes, so a
+	// mismatch is an error unless header_check says otherwise
+	check := config.HeaderCheck
+	if check == "" && !config.Header {
+		check = "error"
+	}
+	switch check {
+	case "", "warn":
+		for _, problem := range problems {
+			log.Printf("Warning: %s", problem)
+		}
+	case "error":
+		if len(problems) > 0 {
+			return fmt.Errorf("config doesn't match the input: %s", strings.Join(problems, "; "))
+		}
+	case "off":
+	default:
+		return fmt.Errorf("unsupported header_check %q (use warn, error or off)", config.HeaderCheck)
+	}
+
+	for i, col := range config.Columns {
+		key, err := normalizeKey(col.Label, opts.normalizeKeys)
+		if err != nil {
+			return fmt.Errorf("-normalize-keys: %v", err)
+		}
+		config.Columns[i].Label = key
+
+		// Override per-column policies for this run
+		if opts.strict {
+			config.Columns[i].TypePolicy = "strict"
+		} else if opts.nullable {
+			config.Columns[i].TypePolicy = "nullable"
+		}
+	}
+	if err := prepareConfig(config); err != nil {
+		return err
+	}
+	if err := resolveConstants(config, opts.constants); err != nil {
+		return err
+	}
+	if err := checkMetaKeys(config); err != nil {
+		return err
+	}
+	order, err := resolveOutputOrder(config)
+	config.outputOrder = order
+	return err
+}
+
+// printCounts reports the result of -count-only.
+func printCounts(w io.Writer, config *Config, total, unique int, startTime time.Time) {
+	fmt.Fprintf(w, "Counted %d rows in %.2f seconds\n", total, time.Since(startTime).Seconds())
+	if config.IgnoreDuplicates {
+		fmt.Fprintf(w, "Found %d unique rows\n", unique)
+	}
+}
+
+// emitSchema writes the output schema of -emit-schema, the table definition
+// of -emit-ddl or the JSON Schema of -emit-json-schema to every output.
+func emitSchema(opts options, config *Config, startTime time.Time) {
+	fields, err := outputSchema(config)
+	if err != nil {
+		log.Fatalf("Unable to emit schema: %v", err)
+	}
+	for _, target := range opts.outputs {
+		switch {
+		case opts.emitDDL != "":
+			err = os.WriteFile(target.Path, []byte(createTable(opts.emitDDL, opts.table, fields)), 0644)
+		case opts.emitJSONSchema:
+			err = writeJSONSchema(target.Path, fields)
+		default:
+			err = writeOutputSchema(target.Path, fields)
+		}
+		if err != nil {
+			log.Fatalf("Failed to write schema: %v", err)
+		}
 	}
-	fmt.Printf("Average processing speed: %.2f rows/second\n", avgSpeed)
+	fmt.Fprintf(opts.progress, "Wrote the schema of %d fields in %.2f seconds\n", len(fields), time.Since(startTime).Seconds())
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// manifestJob is one conversion listed in a -manifest file. Empty fields
+// fall back to the command-line flags.
+type manifestJob struct {
+	Input  string `yaml:"input"`
+	Sheet  string `yaml:"sheet"`
+	Config string `yaml:"config"`
+	Schema string `yaml:"schema"`
+	// Output may carry a format prefix, as with -output
+	Output string `yaml:"output"`
+
+	outputs outputList
+}
+
+// loadManifest reads a YAML list of jobs. Relative paths are resolved against
+// the manifest's directory so a manifest can live next to its files.
+func loadManifest(filename string) ([]manifestJob, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []manifestJob
+	if err := yaml.Unmarshal(data, &jobs); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(filename)
+	resolve := func(path string) string {
+		if path == "" || isURL(path) || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if job.Input == "" {
+			return nil, fmt.Errorf("job %d: input is required", i+1)
+		}
+		job.Input = resolve(job.Input)
+		job.Config = resolve(job.Config)
+		job.Schema = resolve(job.Schema)
+		if job.Output != "" {
+			if err := job.outputs.Set(job.Output); err != nil {
+				return nil, fmt.Errorf("job %d: %v", i+1, err)
+			}
+			job.outputs[0].Path = resolve(job.outputs[0].Path)
+		}
+	}
+	return jobs, nil
+}
+
+// apply returns the run options for the job, based on the flags in opts.
+func (j manifestJob) apply(opts options) options {
+	opts.inputFile = j.Input
+	if j.Sheet != "" {
+		opts.sheet = j.Sheet
+	}
+	if j.Config != "" {
+		opts.configFile = j.Config
+	}
+	if j.Schema != "" {
+		opts.schemaFile = j.Schema
+	}
+	// Copy the targets, as run fills in their formats
+	if j.outputs != nil {
+		opts.outputs = append(outputList(nil), j.outputs...)
+	} else {
+		opts.outputs = append(outputList(nil), opts.outputs...)
+	}
+	return opts
+}
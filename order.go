@@ -0,0 +1,42 @@
+package main
+
+import "sort"
+
+// indexedRecord is a processed record tagged with its row index and
+// duplicate key, as sent by workers under -preserve-order.
+type indexedRecord struct {
+	index int
+	key   string
+	entry map[string]interface{}
+}
+
+// collectRecords receives records until in is closed and then sends them all
+// on the returned channel.
+func collectRecords(in <-chan indexedRecord) <-chan []indexedRecord {
+	out := make(chan []indexedRecord, 1)
+	go func() {
+		var records []indexedRecord
+		for record := range in {
+			records = append(records, record)
+		}
+		out <- records
+	}()
+	return out
+}
+
+// compactRecords sorts collected records into input order and, when dedup is
+// set, keeps only the first record of each key. Skipped rows leave no gaps
+// because only records that were sent are sorted, and since duplicates are
+// decided after sorting, the survivor is always the earliest row, however
+// the workers interleaved.
+func compactRecords(records []indexedRecord, seen *dedupSet, dedup bool) []map[string]interface{} {
+	sort.Slice(records, func(i, j int) bool { return records[i].index < records[j].index })
+	entries := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		if dedup && !seen.add(record.key) {
+			continue
+		}
+		entries = append(entries, record.entry)
+	}
+	return entries
+}
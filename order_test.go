@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// shuffledRecords returns n records whose keys repeat every keys rows, sent
+// out of order by several goroutines the way -preserve-order workers do.
+func shuffledRecords(t *testing.T, n, keys int, seed int64) []indexedRecord {
+	t.Helper()
+	records := make([]indexedRecord, n)
+	for i := range records {
+		records[i] = indexedRecord{
+			index: i,
+			key:   "key-" + strconv.Itoa(i%keys),
+			entry: map[string]interface{}{"row": i},
+		}
+	}
+	rand.New(rand.NewSource(seed)).Shuffle(n, func(i, j int) { records[i], records[j] = records[j], records[i] })
+
+	in := make(chan indexedRecord)
+	collected := collectRecords(in)
+	var wg sync.WaitGroup
+	const senders = 4
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := s; i < n; i += senders {
+				in <- records[i]
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(in)
+	return <-collected
+}
+
+func TestCompactRecordsKeepsInputOrder(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		entries := compactRecords(shuffledRecords(t, 200, 7, seed), newDedupSet(), false)
+		if len(entries) != 200 {
+			t.Fatalf("seed %d: got %d records, want 200", seed, len(entries))
+		}
+		for i, entry := range entries {
+			if entry["row"] != i {
+				t.Fatalf("seed %d: record %d is row %v", seed, i, entry["row"])
+			}
+		}
+	}
+}
+
+func TestCompactRecordsFirstDuplicateWins(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		entries := compactRecords(shuffledRecords(t, 200, 7, seed), newDedupSet(), true)
+		// Key k first appears at row k, so the survivors are rows 0 to 6
+		if len(entries) != 7 {
+			t.Fatalf("seed %d: got %d records, want 7", seed, len(entries))
+		}
+		for i, entry := range entries {
+			if entry["row"] != i {
+				t.Errorf("seed %d: survivor %d is row %v, want %d", seed, i, entry["row"], i)
+			}
+		}
+	}
+}
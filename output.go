@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// outputFormats lists the formats an -output target can be written in.
+var outputFormats = map[string]bool{
+	"json":     true,
+	"ndjson":   true,
+	"csv":      true,
+	"tsv":      true,
+	"arrays":   true,
+	"bson":     true,
+	"protobuf": true,
+	"rows":     true,
+}
+
+// outputTarget is one destination for the processed rows.
+type outputTarget struct {
+	Format string
+	Path   string
+}
+
+// outputList collects repeated -output flags. Each value is a path,
+// optionally prefixed with a format as in "ndjson:out.txt".
+type outputList []outputTarget
+
+func (o *outputList) String() string {
+	parts := make([]string, len(*o))
+	for i, t := range *o {
+		parts[i] = t.Path
+	}
+	return strings.Join(parts, ",")
+}
+
+func (o *outputList) Set(value string) error {
+	if value == "" {
+		return fmt.Errorf("empty output path")
+	}
+	target := outputTarget{Path: value}
+	if i := strings.Index(value, ":"); i > 0 && outputFormats[value[:i]] {
+		target = outputTarget{Format: value[:i], Path: value[i+1:]}
+	}
+	*o = append(*o, target)
+	return nil
+}
+
+// resolveFormats fills in the format of targets that didn't name one, based
+// on the file extension and falling back to defaultFormat.
+func (o outputList) resolveFormats(defaultFormat string) {
+	for i, t := range o {
+		if t.Format != "" {
+			continue
+		}
+		// A .gz suffix compresses the output; the format comes from what's
+		// before it
+		path := t.Path
+		if isGzipPath(path) {
+			path = path[:len(path)-len(".gz")]
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".ndjson", ".jsonl":
+			o[i].Format = "ndjson"
+		case ".csv":
+			o[i].Format = "csv"
+		case ".tsv":
+			o[i].Format = "tsv"
+		case ".bson":
+			o[i].Format = "bson"
+		case ".pb":
+			o[i].Format = "protobuf"
+		default:
+			o[i].Format = defaultFormat
+		}
+	}
+}
+
+// checkClobber returns an error for the first target that already exists.
+// With chunked output the first chunk's file is checked.
+func (o outputList) checkClobber(chunked bool) error {
+	for _, t := range o {
+		path := t.Path
+		if chunked && t.Format != "rows" {
+			path = chunkPath(path, 1)
+		}
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists, use -force to overwrite it", path)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// outputOptions holds the flags that affect how rows are written.
+type outputOptions struct {
+	PerRowKey string
+	// Labels are the configured column labels, in config order
+	Labels   []string
+	QuoteAll bool
+	// ChunkSize splits file outputs into files of at most this many rows
+	ChunkSize int
+	// SanitizeFormulas prefixes CSV text cells that a spreadsheet would run
+	// as a formula with an apostrophe
+	SanitizeFormulas bool
+	// GroupBy are the labels whose values key grouped JSON output
+	GroupBy []string
+	// WriteBuffer is the size of the buffered writer of each output file
+	WriteBuffer int
+	// KeyOrder is the order of keys in JSON objects: sorted, alpha or config
+	KeyOrder string
+	// GzipLevel is the compression level of .gz outputs
+	GzipLevel int
+	// ProtoMessage is the message protobuf outputs encode records as
+	ProtoMessage protoreflect.MessageDescriptor
+}
+
+// writeOutputs writes rows to every target concurrently and returns the first
+// error encountered.
+func writeOutputs(targets outputList, rows []map[string]interface{}, opts outputOptions) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(targets))
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target outputTarget) {
+			defer wg.Done()
+			if err := writeOutput(target, rows, opts); err != nil {
+				errs[i] = fmt.Errorf("%s: %v", target.Path, err)
+			}
+		}(i, target)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseGroupBy resolves the fields of -group-by to output labels. Grouped
+// output is a single JSON object, so every output must be json and can't be
+// chunked.
+func parseGroupBy(opts options, config *Config) ([]string, error) {
+	for _, target := range opts.outputs {
+		if target.Format != "json" {
+			return nil, fmt.Errorf("only json output can be grouped, got %s output %s", target.Format, target.Path)
+		}
+	}
+	if opts.chunkSize > 0 || opts.follow {
+		return nil, fmt.Errorf("can't be combined with -chunk-size or -follow")
+	}
+
+	labels := outputLabels(config)
+	var groupBy []string
+	for _, name := range strings.Split(opts.groupBy, ",") {
+		name = strings.TrimSpace(name)
+		label, ok := labels[name]
+		if !ok && config.Pivot == nil {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		if !ok {
+			label = name
+		}
+		groupBy = append(groupBy, label)
+	}
+	return groupBy, nil
+}
+
+// chunkPath numbers a chunk file, e.g. out.json becomes out_0001.json and
+// out.json.gz becomes out_0001.json.gz.
+func chunkPath(path string, n int) string {
+	suffix := ""
+	if isGzipPath(path) {
+		path, suffix = path[:len(path)-len(".gz")], path[len(path)-len(".gz"):]
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_%04d%s%s", strings.TrimSuffix(path, ext), n, ext, suffix)
+}
+
+func writeOutput(target outputTarget, rows []map[string]interface{}, opts outputOptions) error {
+	if opts.ChunkSize <= 0 || target.Format == "rows" {
+		return writeFile(target, rows, opts)
+	}
+	for n, start := 1, 0; start < len(rows) || n == 1; n, start = n+1, start+opts.ChunkSize {
+		end := start + opts.ChunkSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		chunk := outputTarget{Format: target.Format, Path: chunkPath(target.Path, n)}
+		if err := writeFile(chunk, rows[start:end], opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFile(target outputTarget, rows []map[string]interface{}, opts outputOptions) error {
+	switch target.Format {
+	case "ndjson":
+		return writeNDJSONFile(target.Path, rows, opts)
+	case "csv":
+		return writeCSVFile(target.Path, rows, ',', opts)
+	case "tsv":
+		return writeCSVFile(target.Path, rows, '\t', opts)
+	case "arrays":
+		return writeArraysFile(target.Path, rows, opts)
+	case "bson":
+		return writeBSONFile(target.Path, rows, opts)
+	case "protobuf":
+		return writeProtobufFile(target.Path, rows, opts)
+	case "rows":
+		return writeRowFiles(target.Path, rows, opts)
+	default:
+		if len(opts.GroupBy) > 0 {
+			return writeGroupedJSONFile(target.Path, rows, opts)
+		}
+		return writeJSONFile(target.Path, rows, opts)
+	}
+}
+
+// writeJSONFile writes all rows to filename as a single indented JSON array.
+// Rows are encoded one at a time so the whole document is never held in
+// memory; the result is the same as json.MarshalIndent of the slice.
+func writeJSONFile(filename string, rows []map[string]interface{}, opts outputOptions) error {
+	file, err := createOutput(filename, opts.GzipLevel)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriterSize(file, opts.WriteBuffer)
+	switch {
+	case rows == nil:
+		w.WriteString("null")
+	case len(rows) == 0:
+		w.WriteString("[]")
+	default:
+		w.WriteString("[\n")
+		for i, entry := range rows {
+			payload, err := json.MarshalIndent(opts.ordered(entry), "  ", "  ")
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				w.WriteString(",\n")
+			}
+			w.WriteString("  ")
+			w.Write(payload)
+		}
+		w.WriteString("\n]")
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// writeGroupedJSONFile writes a JSON object mapping each group key to the
+// array of its rows, in row order. Composite keys join the values of the
+// group labels with "|", and keys are rendered as in CSV output, so a
+// missing value gives "".
+func writeGroupedJSONFile(filename string, rows []map[string]interface{}, opts outputOptions) error {
+	groups := make(map[string][]interface{})
+	parts := make([]string, len(opts.GroupBy))
+	for _, entry := range rows {
+		for i, label := range opts.GroupBy {
+			parts[i] = formatCell(entry[label])
+		}
+		key := strings.Join(parts, "|")
+		groups[key] = append(groups[key], opts.ordered(entry))
+	}
+	payload, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := createOutput(filename, opts.GzipLevel)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(payload); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// writeNDJSONFile writes one compact JSON object per line.
+func writeNDJSONFile(filename string, rows []map[string]interface{}, opts outputOptions) error {
+	file, err := createOutput(filename, opts.GzipLevel)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriterSize(file, opts.WriteBuffer)
+	encoder := json.NewEncoder(w)
+	for _, entry := range rows {
+		if err := encoder.Encode(opts.ordered(entry)); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// writeArraysFile writes a JSON array whose first element holds the column
+// labels, chosen as for CSV output, followed by one positional array of
+// values per row, one per line. Fields missing from a row are null.
+func writeArraysFile(filename string, rows []map[string]interface{}, opts outputOptions) error {
+	file, err := createOutput(filename, opts.GzipLevel)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriterSize(file, opts.WriteBuffer)
+	header := csvHeader(rows, opts.Labels)
+	payload, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	w.WriteString("[\n")
+	w.Write(payload)
+
+	values := make([]interface{}, len(header))
+	for _, entry := range rows {
+		for i, label := range header {
+			values[i] = entry[label]
+		}
+		payload, err := json.Marshal(values)
+		if err != nil {
+			return err
+		}
+		w.WriteString(",\n")
+		w.Write(payload)
+	}
+	w.WriteString("\n]\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// writeRowFiles writes every entry to its own JSON file inside dir. Files are
+// named <n>.json by position, or after the value of the -per-row-key column
+// when it is set.
+func writeRowFiles(dir string, rows []map[string]interface{}, opts outputOptions) error {
+	keyLabel := opts.PerRowKey
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	written := make(map[string]struct{}, len(rows))
+	for n, entry := range rows {
+		name := fmt.Sprintf("%d", n+1)
+		if keyLabel != "" {
+			value, ok := entry[keyLabel]
+			if !ok || value == nil {
+				return fmt.Errorf("row %d has no value for key column %q", n+1, keyLabel)
+			}
+			name = sanitizeFileName(fmt.Sprint(value))
+		}
+		if _, exists := written[name]; exists {
+			return fmt.Errorf("duplicate file name %q for key column %q", name, keyLabel)
+		}
+		written[name] = struct{}{}
+
+		payload, err := json.MarshalIndent(opts.ordered(entry), "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".json"), payload, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sanitizeFileName replaces characters that are not safe in a file name.
+func sanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|', 0:
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
+
+// normalizeKey rewrites a column label into an output key style: "snake"
+// (first_name), "camel" (firstName) or "lower" (first name).
+func normalizeKey(label, style string) (string, error) {
+	switch style {
+	case "":
+		return label, nil
+	case "lower":
+		return strings.ToLower(label), nil
+	case "snake", "camel":
+	default:
+		return "", fmt.Errorf("unsupported key style %q", style)
+	}
+
+	words := splitWords(label)
+	for i, w := range words {
+		w = strings.ToLower(w)
+		if style == "camel" && i > 0 {
+			r, size := utf8.DecodeRuneInString(w)
+			w = string(unicode.ToUpper(r)) + w[size:]
+		}
+		words[i] = w
+	}
+	if style == "camel" {
+		return strings.Join(words, ""), nil
+	}
+	return strings.Join(words, "_"), nil
+}
+
+// splitWords breaks a label on anything that isn't a letter or digit and on
+// lower-to-upper case changes, so "First Name" and "FirstName" both give
+// ["First", "Name"].
+func splitWords(label string) []string {
+	var words []string
+	var current []rune
+	flush := func() {
+		if len(current) > 0 {
+			words = append(words, string(current))
+			current = current[:0]
+		}
+	}
+	var prev rune
+	for _, r := range label {
+		switch {
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			flush()
+		case unicode.IsUpper(r) && (unicode.IsLower(prev) || unicode.IsDigit(prev)):
+			flush()
+			current = append(current, r)
+		default:
+			current = append(current, r)
+		}
+		prev = r
+	}
+	flush()
+	return words
+}
+
+// flattenRecords rewrites nested maps and arrays as dotted keys, e.g. a
+// "tags" array becomes "tags.0", "tags.1". Empty maps and arrays are kept as
+// they are. It also returns labels expanded to the flattened keys, in the
+// order they were first seen, so CSV columns stay in config order.
+func flattenRecords(rows []map[string]interface{}, labels []string) ([]map[string]interface{}, []string) {
+	seen := make(map[string]bool)
+	var flatLabels []string
+	addLabel := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			flatLabels = append(flatLabels, key)
+		}
+	}
+
+	isLabel := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		isLabel[label] = true
+	}
+
+	flat := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		record := make(map[string]interface{}, len(row))
+		for _, label := range labels {
+			if v, ok := row[label]; ok {
+				flattenValue(record, label, v, addLabel)
+			}
+		}
+		for k, v := range row {
+			if !isLabel[k] {
+				flattenValue(record, k, v, func(string) {})
+			}
+		}
+		flat[i] = record
+	}
+	return flat, flatLabels
+}
+
+func flattenValue(dst map[string]interface{}, key string, value interface{}, add func(string)) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) > 0 {
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				flattenValue(dst, key+"."+k, v[k], add)
+			}
+			return
+		}
+	case []interface{}:
+		if len(v) > 0 {
+			for i, element := range v {
+				flattenValue(dst, key+"."+strconv.Itoa(i), element, add)
+			}
+			return
+		}
+	}
+	dst[key] = value
+	add(key)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// BSON element types, from https://bsonspec.org/spec.html
+const (
+	bsonDouble   = 0x01
+	bsonString   = 0x02
+	bsonDocument = 0x03
+	bsonArray    = 0x04
+	bsonBool     = 0x08
+	bsonDatetime = 0x09
+	bsonNull     = 0x0A
+	bsonInt32    = 0x10
+	bsonInt64    = 0x12
+)
+
+// writeBSONFile writes every row as a BSON document, one after the other, the
+// layout mongorestore and most BSON tools read. Keys follow -key-order.
+func writeBSONFile(filename string, rows []map[string]interface{}, opts outputOptions) error {
+	file, err := createOutput(filename, opts.GzipLevel)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	order := opts.KeyOrder
+	if order == "" {
+		order = "sorted"
+	}
+	w := bufio.NewWriterSize(file, opts.WriteBuffer)
+	for _, entry := range rows {
+		doc, err := bsonDocumentOf(entry, orderKeys(entry, order, opts.Labels))
+		if err != nil {
+			return err
+		}
+		w.Write(doc)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// bsonDocumentOf encodes the given keys of values as a BSON document.
+func bsonDocumentOf(values map[string]interface{}, keys []string) ([]byte, error) {
+	var body bytes.Buffer
+	for _, key := range keys {
+		if err := appendBSONElement(&body, key, values[key]); err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return finishBSONDocument(body.Bytes()), nil
+}
+
+// finishBSONDocument adds the length prefix and terminator around the
+// encoded elements of a document.
+func finishBSONDocument(elements []byte) []byte {
+	doc := make([]byte, 4, len(elements)+5)
+	binary.LittleEndian.PutUint32(doc, uint32(len(elements)+5))
+	doc = append(doc, elements...)
+	return append(doc, 0)
+}
+
+// appendBSONElement encodes one key and value. Values map to the closest BSON
+// type: ints to int32 when they fit and int64 otherwise, dates to UTC
+// datetimes with millisecond precision, and bools according to bool_format.
+// Anything else goes through its JSON form.
+func appendBSONElement(buf *bytes.Buffer, key string, value interface{}) error {
+	name := func(kind byte) {
+		buf.WriteByte(kind)
+		buf.WriteString(key)
+		buf.WriteByte(0)
+	}
+	switch v := value.(type) {
+	case nil:
+		name(bsonNull)
+	case string:
+		name(bsonString)
+		binary.Write(buf, binary.LittleEndian, int32(len(v)+1))
+		buf.WriteString(v)
+		buf.WriteByte(0)
+	case bool:
+		name(bsonBool)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case boolValue:
+		switch v.format {
+		case "1/0":
+			return appendBSONElement(buf, key, map[bool]int{true: 1, false: 0}[v.value])
+		case "yes/no":
+			return appendBSONElement(buf, key, v.String())
+		}
+		return appendBSONElement(buf, key, v.value)
+	case int:
+		return appendBSONElement(buf, key, int64(v))
+	case int64:
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			name(bsonInt32)
+			binary.Write(buf, binary.LittleEndian, int32(v))
+		} else {
+			name(bsonInt64)
+			binary.Write(buf, binary.LittleEndian, v)
+		}
+	case float64:
+		name(bsonDouble)
+		binary.Write(buf, binary.LittleEndian, math.Float64bits(v))
+	case time.Time:
+		name(bsonDatetime)
+		binary.Write(buf, binary.LittleEndian, v.UnixMilli())
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		doc, err := bsonDocumentOf(v, keys)
+		if err != nil {
+			return err
+		}
+		name(bsonDocument)
+		buf.Write(doc)
+	case []interface{}:
+		// Arrays are documents keyed "0", "1", ...
+		var elements bytes.Buffer
+		for i, item := range v {
+			if err := appendBSONElement(&elements, fmt.Sprint(i), item); err != nil {
+				return err
+			}
+		}
+		name(bsonArray)
+		buf.Write(finishBSONDocument(elements.Bytes()))
+	default:
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.UseNumber()
+		var decoded interface{}
+		if err := decoder.Decode(&decoded); err != nil {
+			return err
+		}
+		return appendBSONElement(buf, key, fromJSONNumbers(decoded))
+	}
+	return nil
+}
+
+// fromJSONNumbers replaces the json.Numbers of a decoded value with int64
+// for integers and float64 otherwise.
+func fromJSONNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = fromJSONNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = fromJSONNumbers(item)
+		}
+	}
+	return value
+}
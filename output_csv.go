@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvHeader returns the CSV columns for rows: the configured labels that
+// appear in any row, in config order, followed by any other keys (for
+// example from pivot or unpivot) sorted by name.
+func csvHeader(rows []map[string]interface{}, labels []string) []string {
+	present := make(map[string]bool)
+	for _, entry := range rows {
+		for k := range entry {
+			present[k] = true
+		}
+	}
+
+	header := make([]string, 0, len(present))
+	for _, label := range labels {
+		if present[label] {
+			header = append(header, label)
+			delete(present, label)
+		}
+	}
+	extra := make([]string, 0, len(present))
+	for k := range present {
+		extra = append(extra, k)
+	}
+	sort.Strings(extra)
+	return append(header, extra...)
+}
+
+// formatCell renders a processed value as CSV text, matching how the value
+// appears in JSON output.
+func formatCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case fmt.Stringer:
+		return v.String()
+	case int, int64, bool:
+		return fmt.Sprint(v)
+	default:
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(payload)
+	}
+}
+
+// sanitizeFormula guards against CSV injection by prefixing text that starts
+// with a formula character (=, +, -, @, tab or carriage return) with an
+// apostrophe, which spreadsheets show as text. Numbers, such as negative
+// ints, are left alone since they can't hold a formula.
+func sanitizeFormula(value interface{}, cell string) string {
+	if _, isText := value.(string); !isText || cell == "" {
+		return cell
+	}
+	switch cell[0] {
+	case '=', '+', '-', '@', '\t', '\r':
+		return "'" + cell
+	}
+	return cell
+}
+
+// writeCSVFile writes rows as CSV, or TSV when comma is '\t', with a header
+// line. encoding/csv only quotes fields when needed, so quoteAll is
+// implemented by hand.
+func writeCSVFile(filename string, rows []map[string]interface{}, comma rune, opts outputOptions) error {
+	file, err := createOutput(filename, opts.GzipLevel)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriterSize(file, opts.WriteBuffer)
+	header := csvHeader(rows, opts.Labels)
+	record := make([]string, len(header))
+
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	writeRecord := cw.Write
+	if opts.QuoteAll {
+		writeRecord = func(fields []string) error {
+			for i, f := range fields {
+				if i > 0 {
+					w.WriteRune(comma)
+				}
+				w.WriteString(`"` + strings.ReplaceAll(f, `"`, `""`) + `"`)
+			}
+			_, err := w.WriteString("\n")
+			return err
+		}
+	}
+
+	if err := writeRecord(header); err != nil {
+		return err
+	}
+	for _, entry := range rows {
+		for i, label := range header {
+			record[i] = formatCell(entry[label])
+			if opts.SanitizeFormulas {
+				record[i] = sanitizeFormula(entry[label], record[i])
+			}
+		}
+		if err := writeRecord(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+)
+
+// isGzipPath reports whether an output path asks for gzip compression.
+func isGzipPath(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ".gz")
+}
+
+// outputFile is a created output file, gzip-compressed at the given level
+// when its name ends in .gz. Close may be called more than once.
+type outputFile struct {
+	file   *os.File
+	gz     *gzip.Writer
+	w      io.Writer
+	closed bool
+}
+
+func createOutput(filename string, level int) (*outputFile, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	f := &outputFile{file: file, w: file}
+	if isGzipPath(filename) {
+		if f.gz, err = gzip.NewWriterLevel(file, level); err != nil {
+			file.Close()
+			return nil, err
+		}
+		f.w = f.gz
+	}
+	return f, nil
+}
+
+func (f *outputFile) Write(p []byte) (int, error) { return f.w.Write(p) }
+
+// Flush pushes pending compressed data to the file, so readers of a followed
+// output see every complete record.
+func (f *outputFile) Flush() error {
+	if f.gz == nil {
+		return nil
+	}
+	return f.gz.Flush()
+}
+
+func (f *outputFile) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	if f.gz != nil {
+		if err := f.gz.Close(); err != nil {
+			f.file.Close()
+			return err
+		}
+	}
+	return f.file.Close()
+}
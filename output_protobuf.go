@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// loadProtoMessage reads a FileDescriptorSet, as written by protoc
+// --include_imports --descriptor_set_out, and returns the message named
+// name, such as "hr.Employee". name can be left empty when the set defines
+// a single top-level message outside its imports.
+func loadProtoMessage(filename, name string) (protoreflect.MessageDescriptor, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("not a FileDescriptorSet: %v", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, err
+	}
+
+	if name != "" {
+		desc, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			return nil, fmt.Errorf("no message %s in %s", name, filename)
+		}
+		message, ok := desc.(protoreflect.MessageDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a message", name)
+		}
+		return message, nil
+	}
+	// Imports, such as google/protobuf/timestamp.proto, don't count
+	imported := make(map[string]bool)
+	for _, file := range set.File {
+		for _, dep := range file.Dependency {
+			imported[dep] = true
+		}
+	}
+	var messages []protoreflect.MessageDescriptor
+	files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		for i := 0; i < file.Messages().Len() && !imported[file.Path()]; i++ {
+			messages = append(messages, file.Messages().Get(i))
+		}
+		return true
+	})
+	if len(messages) != 1 {
+		return nil, fmt.Errorf("%s defines %d messages, pick one with -proto-message", filename, len(messages))
+	}
+	return messages[0], nil
+}
+
+// writeProtobufFile writes every row as a length-delimited message of
+// opts.ProtoMessage: the message size as a varint followed by its encoding,
+// the framing of Java's writeDelimitedTo and Go's protodelim.
+func writeProtobufFile(filename string, rows []map[string]interface{}, opts outputOptions) error {
+	if opts.ProtoMessage == nil {
+		return fmt.Errorf("protobuf output needs -proto-descriptor")
+	}
+	file, err := createOutput(filename, opts.GzipLevel)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriterSize(file, opts.WriteBuffer)
+	for _, entry := range rows {
+		message, err := protoMessageOf(entry, opts.ProtoMessage)
+		if err != nil {
+			return err
+		}
+		if _, err := protodelim.MarshalTo(w, message.Interface()); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// protoField finds the field a record key is written to: the field of that
+// name, or failing that of that JSON name, or of its snake case form, so
+// "First Name" goes to first_name.
+func protoField(desc protoreflect.MessageDescriptor, key string) protoreflect.FieldDescriptor {
+	fields := desc.Fields()
+	if field := fields.ByName(protoreflect.Name(key)); field != nil {
+		return field
+	}
+	if field := fields.ByJSONName(key); field != nil {
+		return field
+	}
+	snake, _ := normalizeKey(key, "snake")
+	return fields.ByName(protoreflect.Name(snake))
+}
+
+// protoMessageOf sets the fields of a new desc message from a record. Nulls
+// leave fields unset, and keys without a field are an error.
+func protoMessageOf(values map[string]interface{}, desc protoreflect.MessageDescriptor) (protoreflect.Message, error) {
+	message := dynamicpb.NewMessage(desc)
+	for key, value := range values {
+		field := protoField(desc, key)
+		if field == nil {
+			return nil, fmt.Errorf("%s: no field of message %s", key, desc.FullName())
+		}
+		if value == nil {
+			continue
+		}
+		if err := setProtoField(message, field, value); err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return message, nil
+}
+
+// setProtoField sets a field, appending the elements of arrays to repeated
+// fields and the entries of objects to map fields.
+func setProtoField(message protoreflect.Message, field protoreflect.FieldDescriptor, value interface{}) error {
+	if field.IsMap() {
+		return fillProtoMap(message.Mutable(field).Map(), field, value)
+	}
+	if !field.IsList() {
+		v, err := protoValue(message, field, value)
+		if err != nil {
+			return err
+		}
+		message.Set(field, v)
+		return nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return fmt.Errorf("repeated field %s needs an array", field.Name())
+	}
+	list := message.Mutable(field).List()
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		var v protoreflect.Value
+		var err error
+		if field.Kind() == protoreflect.MessageKind {
+			v = list.NewElement()
+			err = fillProtoMessage(v.Message(), item)
+		} else {
+			v, err = protoScalar(field, item)
+		}
+		if err != nil {
+			return err
+		}
+		list.Append(v)
+	}
+	return nil
+}
+
+// fillProtoMap adds the entries of an object to a map field. Keys are parsed
+// as the map's key type, so {"1": ...} fills a map<int32, ...>.
+func fillProtoMap(entries protoreflect.Map, field protoreflect.FieldDescriptor, value interface{}) error {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		decoded, err := decodeJSONForm(value)
+		if err != nil {
+			return err
+		}
+		if object, ok = decoded.(map[string]interface{}); !ok {
+			return fmt.Errorf("map field %s needs an object", field.Name())
+		}
+	}
+	keyField, valueField := field.MapKey(), field.MapValue()
+	for key, item := range object {
+		if item == nil {
+			continue
+		}
+		var k interface{} = key
+		switch keyField.Kind() {
+		case protoreflect.StringKind:
+		case protoreflect.BoolKind:
+			if b, err := strconv.ParseBool(key); err == nil {
+				k = b
+			}
+		default:
+			if n, err := strconv.ParseInt(key, 10, 64); err == nil {
+				k = n
+			}
+		}
+		mapKey, err := protoScalar(keyField, k)
+		if err != nil {
+			return err
+		}
+		var v protoreflect.Value
+		if valueField.Kind() == protoreflect.MessageKind {
+			v = entries.NewValue()
+			err = fillProtoMessage(v.Message(), item)
+		} else {
+			v, err = protoScalar(valueField, item)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		entries.Set(mapKey.MapKey(), v)
+	}
+	return nil
+}
+
+// protoValue converts a value to a singular field of message.
+func protoValue(message protoreflect.Message, field protoreflect.FieldDescriptor, value interface{}) (protoreflect.Value, error) {
+	if field.Kind() != protoreflect.MessageKind && field.Kind() != protoreflect.GroupKind {
+		return protoScalar(field, value)
+	}
+	v := message.NewField(field)
+	return v, fillProtoMessage(v.Message(), value)
+}
+
+// fillProtoMessage sets the fields of a nested message from an object, or
+// from a date for google.protobuf.Timestamp. Other values, such as money and
+// quantities, go through their JSON form.
+func fillProtoMessage(message protoreflect.Message, value interface{}) error {
+	desc := message.Descriptor()
+	if t, ok := value.(time.Time); ok {
+		if desc.FullName() != "google.protobuf.Timestamp" {
+			return fmt.Errorf("dates need a google.protobuf.Timestamp or string field, not %s", desc.FullName())
+		}
+		message.Set(desc.Fields().ByName("seconds"), protoreflect.ValueOfInt64(t.Unix()))
+		message.Set(desc.Fields().ByName("nanos"), protoreflect.ValueOfInt32(int32(t.Nanosecond())))
+		return nil
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		decoded, err := decodeJSONForm(value)
+		if err != nil {
+			return err
+		}
+		if object, ok = decoded.(map[string]interface{}); !ok {
+			return fmt.Errorf("message field %s needs an object", desc.FullName())
+		}
+	}
+	for key, item := range object {
+		field := protoField(desc, key)
+		if field == nil {
+			return fmt.Errorf("no field %s in message %s", key, desc.FullName())
+		}
+		if item == nil {
+			continue
+		}
+		if err := setProtoField(message, field, item); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// decodeJSONForm returns a value as encoding/json would decode its JSON form,
+// with int64 and float64 numbers.
+func decodeJSONForm(value interface{}) (interface{}, error) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return fromJSONNumbers(decoded), nil
+}
+
+// isProtoInteger reports whether kind is one of the integer field kinds.
+func isProtoInteger(kind protoreflect.Kind) bool {
+	switch kind {
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return true
+	}
+	return false
+}
+
+// protoScalar converts a value to a scalar or enum field. Numbers must fit
+// the field's type, floats only going to integer fields when whole, enums take value names or numbers, dates written to
+// string fields are RFC 3339 and bools follow bool_format only there.
+func protoScalar(field protoreflect.FieldDescriptor, value interface{}) (protoreflect.Value, error) {
+	switch v := value.(type) {
+	case int:
+		value = int64(v)
+	case boolValue:
+		if field.Kind() == protoreflect.StringKind {
+			return protoreflect.ValueOfString(v.String()), nil
+		}
+		value = v.value
+	case time.Time:
+		if field.Kind() == protoreflect.StringKind {
+			return protoreflect.ValueOfString(v.Format(time.RFC3339Nano)), nil
+		}
+	case float64:
+		// Whole numbers, such as JSON array elements or scaled values, fit
+		// integer fields; the range is checked below
+		if isProtoInteger(field.Kind()) && v == math.Trunc(v) {
+			if field.Kind() == protoreflect.Uint64Kind || field.Kind() == protoreflect.Fixed64Kind {
+				if v >= 0 && v < math.Exp2(64) {
+					return protoreflect.ValueOfUint64(uint64(v)), nil
+				}
+			} else if v >= math.MinInt64 && v < math.Exp2(63) {
+				value = int64(v)
+			}
+		}
+	}
+
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		if b, ok := value.(bool); ok {
+			return protoreflect.ValueOfBool(b), nil
+		}
+	case protoreflect.StringKind:
+		if s, ok := value.(string); ok {
+			return protoreflect.ValueOfString(s), nil
+		}
+		if s, ok := value.(fmt.Stringer); ok {
+			return protoreflect.ValueOfString(s.String()), nil
+		}
+	case protoreflect.BytesKind:
+		if s, ok := value.(string); ok {
+			return protoreflect.ValueOfBytes([]byte(s)), nil
+		}
+	case protoreflect.DoubleKind:
+		switch n := value.(type) {
+		case int64:
+			return protoreflect.ValueOfFloat64(float64(n)), nil
+		case float64:
+			return protoreflect.ValueOfFloat64(n), nil
+		}
+	case protoreflect.FloatKind:
+		switch n := value.(type) {
+		case int64:
+			return protoreflect.ValueOfFloat32(float32(n)), nil
+		case float64:
+			return protoreflect.ValueOfFloat32(float32(n)), nil
+		}
+	case protoreflect.EnumKind:
+		values := field.Enum().Values()
+		switch v := value.(type) {
+		case string:
+			if e := values.ByName(protoreflect.Name(v)); e != nil {
+				return protoreflect.ValueOfEnum(e.Number()), nil
+			}
+		case int64:
+			if e := values.ByNumber(protoreflect.EnumNumber(v)); e != nil {
+				return protoreflect.ValueOfEnum(e.Number()), nil
+			}
+		}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		if n, ok := value.(int64); ok && n >= math.MinInt32 && n <= math.MaxInt32 {
+			return protoreflect.ValueOfInt32(int32(n)), nil
+		}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		if n, ok := value.(int64); ok {
+			return protoreflect.ValueOfInt64(n), nil
+		}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		if n, ok := value.(int64); ok && n >= 0 && n <= math.MaxUint32 {
+			return protoreflect.ValueOfUint32(uint32(n)), nil
+		}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if n, ok := value.(int64); ok && n >= 0 {
+			return protoreflect.ValueOfUint64(uint64(n)), nil
+		}
+	}
+	return protoreflect.Value{}, fmt.Errorf("can't write %v to %s field %s", value, field.Kind(), field.Name())
+}
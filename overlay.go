@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pathList collects repeated path flags in the order given.
+type pathList []string
+
+func (p *pathList) String() string { return strings.Join(*p, ",") }
+
+func (p *pathList) Set(value string) error {
+	if value == "" {
+		return fmt.Errorf("empty path")
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+// mergeConfig deep-merges an overlay config onto a base one. Mappings merge
+// key by key and any other overlay value, including lists and null, replaces
+// the base value. Columns are the exception: an overlay column merges into the
+// base column with the same field, and columns with a new field are appended.
+func mergeConfig(base, overlay map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+	merged := mergeMappings(base, overlay)
+	baseColumns, _ := base["columns"].([]interface{})
+	overlayColumns, ok := overlay["columns"].([]interface{})
+	if !ok {
+		return merged, nil
+	}
+
+	columns := append([]interface{}(nil), baseColumns...)
+	for i, item := range overlayColumns {
+		column, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("column %d of the overlay is %s, not column settings", i+1, yamlKind(item))
+		}
+		field, ok := column["field"]
+		if !ok {
+			return nil, fmt.Errorf("column %d of the overlay needs a field to match", i+1)
+		}
+		matched := false
+		for j, existing := range columns {
+			if target, ok := existing.(map[interface{}]interface{}); ok && fmt.Sprint(target["field"]) == fmt.Sprint(field) {
+				columns[j] = mergeMappings(target, column)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			columns = append(columns, column)
+		}
+	}
+	merged["columns"] = columns
+	return merged, nil
+}
+
+// mergeMappings returns a copy of base with overlay merged in, recursing into
+// mappings present in both.
+func mergeMappings(base, overlay map[interface{}]interface{}) map[interface{}]interface{} {
+	merged := make(map[interface{}]interface{}, len(base)+len(overlay))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overlay {
+		if from, ok := merged[key].(map[interface{}]interface{}); ok {
+			if to, ok := value.(map[interface{}]interface{}); ok {
+				merged[key] = mergeMappings(from, to)
+				continue
+			}
+		}
+		merged[key] = value
+	}
+	return merged
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// quoteAwareParser is a small RFC 4180 style CSV parser used instead of
+// encoding/csv when the config needs information the stdlib reader throws
+// away, such as whether an empty field was written as "". It reads the whole
+// input into records and, for each record, marks which fields were quoted
+// empty strings. It supports the same record separators as encoding/csv, but
+// not its options such as lazy quotes, comments or trimming leading space,
+// and it reports fewer details on malformed input.
+type quoteAwareParser struct {
+	comma rune
+	quote rune
+}
+
+// parse returns the records of r and, per record, which fields were quoted
+// empty strings. quotedEmpty[i] is nil when record i has none.
+func (p quoteAwareParser) parse(r io.Reader) (records [][]string, quotedEmpty [][]bool, err error) {
+	br := bufio.NewReader(r)
+	line := 1
+
+	var (
+		record  []string
+		flags   []bool
+		field   []rune
+		quoted  bool // the current field started with a quote
+		inQuote bool // inside a quoted section
+		started bool // the current record has any content
+	)
+	endField := func() {
+		record = append(record, string(field))
+		flags = append(flags, quoted && len(field) == 0)
+		field, quoted = field[:0], false
+	}
+	endRecord := func() {
+		endField()
+		var marks []bool
+		for _, f := range flags {
+			if f {
+				marks = flags
+				break
+			}
+		}
+		records = append(records, record)
+		quotedEmpty = append(quotedEmpty, marks)
+		record, flags, started = nil, nil, false
+	}
+
+	for {
+		c, _, err := br.ReadRune()
+		if err == io.EOF {
+			if inQuote {
+				return nil, nil, fmt.Errorf("line %d: unterminated quoted field", line)
+			}
+			if started {
+				endRecord()
+			}
+			return records, quotedEmpty, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if inQuote {
+			if c == '\n' {
+				line++
+			}
+			if c != p.quote {
+				field = append(field, c)
+				continue
+			}
+			next, _, err := br.ReadRune()
+			if err == nil && next == p.quote {
+				field = append(field, p.quote)
+				continue
+			}
+			if err == nil {
+				br.UnreadRune()
+			}
+			inQuote = false
+			continue
+		}
+
+		switch {
+		case c == p.quote && len(field) == 0 && !quoted:
+			quoted, inQuote, started = true, true, true
+		case c == p.comma:
+			endField()
+			started = true
+		case c == '\r':
+			// Treat "\r\n" as "\n" and drop a carriage return at the end of
+			// the input, as encoding/csv does, but keep one inside a field
+			next, _, err := br.ReadRune()
+			if err == nil {
+				br.UnreadRune()
+			}
+			if err == nil && next != '\n' {
+				field = append(field, c)
+				started = true
+			}
+		case c == '\n':
+			line++
+			if started {
+				endRecord()
+			}
+		default:
+			field = append(field, c)
+			started = true
+		}
+	}
+}
+
+// readQuoteAwareCSV reads r with quoteAwareParser, splitting off the header
+// when the config has one. It also reads input with a quote_char, which
+// encoding/csv can't be configured for.
+func readQuoteAwareCSV(r io.Reader, config *Config) ([]string, [][]string, [][]bool, error) {
+	parser := quoteAwareParser{comma: ',', quote: '"'}
+	if config.comma != 0 {
+		parser.comma = config.comma
+	}
+	if config.QuoteChar != "" {
+		parser.quote, _ = utf8.DecodeRuneInString(config.QuoteChar)
+	}
+	records, quotedEmpty, err := parser.parse(newSeparatorReader(r, config.RecordSeparator))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if config.Header && len(records) > 0 {
+		return records[0], records[1:], quotedEmpty[1:], nil
+	}
+	return nil, records, quotedEmpty, nil
+}
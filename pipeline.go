@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// pipelineStep transforms a raw value. Steps that validate return an error
+// for values they reject, which then follow the column's type_policy.
+type pipelineStep func(value string, col ColumnConfig) (string, error)
+
+// pipelineSteps builds the step named by a pipeline entry from its argument,
+// the text after the first ":". Steps without arguments get "".
+var pipelineSteps = map[string]func(arg string) (pipelineStep, error){
+	"trim": func(arg string) (pipelineStep, error) {
+		return func(value string, _ ColumnConfig) (string, error) {
+			if arg == "" {
+				return strings.TrimSpace(value), nil
+			}
+			return strings.Trim(value, arg), nil
+		}, nil
+	},
+	"lower": noArgStep(strings.ToLower),
+	"upper": noArgStep(strings.ToUpper),
+	"collapse_spaces": noArgStep(func(value string) string {
+		return strings.Join(strings.Fields(value), " ")
+	}),
+	"digits": noArgStep(func(value string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) {
+				return r
+			}
+			return -1
+		}, value)
+	}),
+	"remove": func(arg string) (pipelineStep, error) {
+		if arg == "" {
+			return nil, fmt.Errorf("remove needs the characters to remove, e.g. remove:-")
+		}
+		return func(value string, _ ColumnConfig) (string, error) {
+			return strings.Map(func(r rune) rune {
+				if strings.ContainsRune(arg, r) {
+					return -1
+				}
+				return r
+			}, value), nil
+		}, nil
+	},
+	"replace": func(arg string) (pipelineStep, error) {
+		from, to, ok := strings.Cut(arg, "=")
+		if !ok || from == "" {
+			return nil, fmt.Errorf("replace needs FROM=TO, e.g. replace:,=.")
+		}
+		return func(value string, _ ColumnConfig) (string, error) {
+			return strings.ReplaceAll(value, from, to), nil
+		}, nil
+	},
+	"strip_prefix": func(arg string) (pipelineStep, error) {
+		return func(value string, _ ColumnConfig) (string, error) {
+			return strings.TrimPrefix(value, arg), nil
+		}, nil
+	},
+	"strip_suffix": func(arg string) (pipelineStep, error) {
+		return func(value string, _ ColumnConfig) (string, error) {
+			return strings.TrimSuffix(value, arg), nil
+		}, nil
+	},
+	"truncate": func(arg string) (pipelineStep, error) {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("truncate needs a number of characters, e.g. truncate:10")
+		}
+		return func(value string, _ ColumnConfig) (string, error) {
+			if runes := []rune(value); len(runes) > n {
+				return string(runes[:n]), nil
+			}
+			return value, nil
+		}, nil
+	},
+	"validate": func(arg string) (pipelineStep, error) {
+		pattern, err := regexp.Compile("^(?:" + arg + ")$")
+		if err != nil || arg == "" {
+			return nil, fmt.Errorf("validate needs a regular expression, e.g. validate:[A-Z]{2}")
+		}
+		return func(value string, col ColumnConfig) (string, error) {
+			if value != "" && !pattern.MatchString(value) {
+				return value, fmt.Errorf("Value %s for column %s doesn't match %s", value, col.Field, arg)
+			}
+			return value, nil
+		}, nil
+	},
+}
+
+// noArgStep turns a string function into a pipeline step.
+func noArgStep(transform func(string) string) func(string) (pipelineStep, error) {
+	return func(string) (pipelineStep, error) {
+		return func(value string, _ ColumnConfig) (string, error) {
+			return transform(value), nil
+		}, nil
+	}
+}
+
+// resolvePipelines builds the steps of every column's pipeline.
+func resolvePipelines(config *Config) error {
+	for i, col := range config.Columns {
+		steps := make([]pipelineStep, len(col.Pipeline))
+		for j, entry := range col.Pipeline {
+			name, arg, _ := strings.Cut(entry, ":")
+			build, ok := pipelineSteps[name]
+			if !ok {
+				return fmt.Errorf("column %s: unknown pipeline step %q", col.Field, name)
+			}
+			step, err := build(arg)
+			if err != nil {
+				return fmt.Errorf("column %s: pipeline step %d: %v", col.Field, j+1, err)
+			}
+			steps[j] = step
+		}
+		config.Columns[i].pipeline = steps
+	}
+	return nil
+}
+
+// applyPipeline runs value through the column's pipeline steps in order,
+// stopping at the first step that rejects it.
+func applyPipeline(value string, col ColumnConfig) (string, error) {
+	for _, step := range col.pipeline {
+		var err error
+		if value, err = step(value, col); err != nil {
+			return value, err
+		}
+	}
+	return value, nil
+}
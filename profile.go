@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startCPUProfile starts writing a CPU profile to filename. The returned
+// function stops the profile and must be called before exiting.
+func startCPUProfile(filename string) (func(), error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		file.Close()
+	}, nil
+}
+
+// writeMemProfile writes a heap profile to filename after forcing a GC so the
+// profile reflects live memory.
+func writeMemProfile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(file); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// servePprof exposes the net/http/pprof handlers on addr in the background.
+func servePprof(addr string) {
+	go func() {
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			log.Printf("Warning: pprof server stopped: %v", err)
+		}
+	}()
+}
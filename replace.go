@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ReplaceRule substitutes To for every occurrence of From in a raw value. With
+// Regex, From is a regular expression and To may refer to its groups as $1.
+type ReplaceRule struct {
+	From  string `yaml:"from"`
+	To    string `yaml:"to"`
+	Regex bool   `yaml:"regex"`
+
+	pattern *regexp.Regexp
+}
+
+// resolveReplacements compiles the regex replace rules of every column.
+func resolveReplacements(config *Config) error {
+	for i, col := range config.Columns {
+		for j, rule := range col.Replace {
+			if rule.From == "" {
+				return fmt.Errorf("column %s: replace rule %d has no from", col.Field, j+1)
+			}
+			if !rule.Regex {
+				continue
+			}
+			pattern, err := regexp.Compile(rule.From)
+			if err != nil {
+				return fmt.Errorf("column %s: replace rule %d: %v", col.Field, j+1, err)
+			}
+			config.Columns[i].Replace[j].pattern = pattern
+		}
+	}
+	return nil
+}
+
+// applyReplacements runs the column's replace rules over value in order.
+func applyReplacements(value string, col ColumnConfig) string {
+	for _, rule := range col.Replace {
+		if rule.pattern != nil {
+			value = rule.pattern.ReplaceAllString(value, rule.To)
+		} else {
+			value = strings.ReplaceAll(value, rule.From, rule.To)
+		}
+	}
+	return value
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// qualityReport aggregates per-column data quality counters while rows are
+// processed. It is safe for concurrent use.
+type qualityReport struct {
+	mu      sync.Mutex
+	columns []*columnReport
+	byLabel map[string]*columnReport
+}
+
+type columnReport struct {
+	Field    string   `json:"field"`
+	Label    string   `json:"label"`
+	Type     string   `json:"type"`
+	Values   int      `json:"values"`
+	Nulls    int      `json:"nulls"`
+	Defaults int      `json:"defaults_applied"`
+	Failures int      `json:"parse_failures"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Distinct *int     `json:"distinct,omitempty"`
+
+	distinct map[float64]struct{}
+	// empty counts values that ended up null or defaulted, for max_null_rate
+	empty       int
+	maxNullRate *float64
+}
+
+func newQualityReport(columns []ColumnConfig) *qualityReport {
+	r := &qualityReport{byLabel: make(map[string]*columnReport, len(columns))}
+	for _, col := range columns {
+		if isComputed(col) {
+			continue
+		}
+		c := &columnReport{Field: col.Field, Label: col.Label, Type: col.Type, maxNullRate: col.MaxNullRate}
+		if isNumeric(col.Type) || col.Type == "duration" {
+			c.distinct = make(map[float64]struct{})
+		}
+		r.columns = append(r.columns, c)
+		r.byLabel[col.Label] = c
+	}
+	return r
+}
+
+// record adds one cast value to the column's counters.
+func (r *qualityReport) record(label string, value interface{}, outcome castOutcome) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.byLabel[label]
+	if !ok {
+		return
+	}
+	c.Values++
+	if outcome.Defaulted {
+		c.Defaults++
+	}
+	if outcome.Defaulted || value == nil {
+		c.empty++
+	}
+	if outcome.Failed {
+		c.Failures++
+	}
+
+	var n float64
+	switch v := value.(type) {
+	case nil:
+		c.Nulls++
+		return
+	case int:
+		n = float64(v)
+	case int64:
+		n = float64(v)
+	case float64:
+		n = v
+	default:
+		return
+	}
+	if c.distinct == nil {
+		return
+	}
+	if c.Min == nil || n < *c.Min {
+		c.Min = &n
+	}
+	if c.Max == nil || n > *c.Max {
+		c.Max = &n
+	}
+	c.distinct[n] = struct{}{}
+}
+
+// hasNullRates reports whether any column sets max_null_rate.
+func hasNullRates(config *Config) bool {
+	for _, col := range config.Columns {
+		if col.MaxNullRate != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// write stores the report as indented JSON, with columns in config order.
+func (r *qualityReport) write(filename string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.columns {
+		if c.distinct != nil {
+			distinct := len(c.distinct)
+			c.Distinct = &distinct
+		}
+	}
+	payload, err := json.MarshalIndent(map[string]interface{}{"columns": r.columns}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, payload, 0644)
+}
+
+// nullRateProblems describes every column whose share of null or defaulted
+// values is above its max_null_rate.
+func (r *qualityReport) nullRateProblems() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var problems []string
+	for _, c := range r.columns {
+		if c.maxNullRate == nil || c.Values == 0 {
+			continue
+		}
+		rate := float64(c.empty) / float64(c.Values)
+		if rate > *c.maxNullRate {
+			problems = append(problems, fmt.Sprintf("column %s has %.1f%% null or defaulted values (%d of %d), above max_null_rate %g",
+				c.Field, 100*rate, c.empty, c.Values, *c.maxNullRate))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,133 @@
+package main
+
+import "fmt"
+
+// UnpivotConfig melts a set of columns into one output record per column,
+// holding the column's label under Key and its value under Value.
+type UnpivotConfig struct {
+	Columns []string `yaml:"columns"`
+	Key     string   `yaml:"key"`
+	Value   string   `yaml:"value"`
+
+	labels []string
+}
+
+// resolveUnpivot maps the melted fields to their output labels.
+func resolveUnpivot(config *Config) error {
+	u := config.Unpivot
+	if u == nil {
+		return nil
+	}
+	if u.Key == "" || u.Value == "" {
+		return fmt.Errorf("unpivot needs both a key and a value name")
+	}
+	if len(u.Columns) == 0 {
+		return fmt.Errorf("unpivot needs at least one column")
+	}
+
+	labels := make(map[string]string, len(config.Columns))
+	for _, col := range config.Columns {
+		labels[col.Field] = col.Label
+	}
+	u.labels = make([]string, 0, len(u.Columns))
+	for _, field := range u.Columns {
+		label, ok := labels[field]
+		if !ok {
+			return fmt.Errorf("unpivot: unknown column %q", field)
+		}
+		u.labels = append(u.labels, label)
+	}
+	return nil
+}
+
+// unpivot splits entry into one record per melted column. Columns that are
+// not melted are copied into every record.
+func unpivot(entry map[string]interface{}, u *UnpivotConfig) []map[string]interface{} {
+	base := make(map[string]interface{}, len(entry))
+	for k, v := range entry {
+		base[k] = v
+	}
+	for _, label := range u.labels {
+		delete(base, label)
+	}
+
+	records := make([]map[string]interface{}, 0, len(u.labels))
+	for _, label := range u.labels {
+		value, ok := entry[label]
+		if !ok {
+			continue
+		}
+		record := make(map[string]interface{}, len(base)+2)
+		for k, v := range base {
+			record[k] = v
+		}
+		record[u.Key] = label
+		record[u.Value] = value
+		records = append(records, record)
+	}
+	return records
+}
+
+// PivotConfig groups records by the Id field and turns the values of the Key
+// field into output field names holding the matching Value.
+type PivotConfig struct {
+	Id    string `yaml:"id"`
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+
+	idLabel, keyLabel, valueLabel string
+}
+
+// resolvePivot maps the pivot fields to their output labels.
+func resolvePivot(config *Config) error {
+	p := config.Pivot
+	if p == nil {
+		return nil
+	}
+	if config.Unpivot != nil {
+		return fmt.Errorf("pivot and unpivot can't be combined")
+	}
+
+	labels := make(map[string]string, len(config.Columns))
+	for _, col := range config.Columns {
+		labels[col.Field] = col.Label
+	}
+	for _, f := range []struct {
+		name  string
+		field string
+		label *string
+	}{
+		{"id", p.Id, &p.idLabel},
+		{"key", p.Key, &p.keyLabel},
+		{"value", p.Value, &p.valueLabel},
+	} {
+		label, ok := labels[f.field]
+		if !ok {
+			return fmt.Errorf("pivot: unknown %s column %q", f.name, f.field)
+		}
+		*f.label = label
+	}
+	return nil
+}
+
+// pivot buffers all records and emits one record per id, in the order each
+// id was first seen. Later values for the same id and key win.
+func pivot(records []map[string]interface{}, p *PivotConfig) []map[string]interface{} {
+	groups := make(map[string]map[string]interface{})
+	var result []map[string]interface{}
+	for _, record := range records {
+		id := fmt.Sprint(record[p.idLabel])
+		group, ok := groups[id]
+		if !ok {
+			group = map[string]interface{}{p.idLabel: record[p.idLabel]}
+			groups[id] = group
+			result = append(result, group)
+		}
+		key, ok := record[p.keyLabel]
+		if !ok || key == nil {
+			continue
+		}
+		group[fmt.Sprint(key)] = record[p.valueLabel]
+	}
+	return result
+}
@@ -0,0 +1,155 @@
+package main
+
+import "fmt"
+
+// RoutingConfig splits the output records between files: each record goes
+// to the output of the first route it matches, or to Default when none
+// does. Records matching nothing are dropped when there is no default.
+type RoutingConfig struct {
+	Routes  []Route `yaml:"routes"`
+	Default string  `yaml:"default"`
+
+	defaultTarget *outputTarget
+}
+
+// Route sends records whose Field compares to Value by Op to Output. Value is
+// cast like the column it is compared with, and Output takes a format prefix
+// like -output.
+type Route struct {
+	Field  string `yaml:"field"`
+	Op     string `yaml:"op"`
+	Value  string `yaml:"value"`
+	Output string `yaml:"output"`
+
+	label  string
+	value  interface{}
+	target outputTarget
+}
+
+// routeOps are the comparisons a route can use; "=" is the default.
+var routeOps = map[string]func(c int) bool{
+	"=":  func(c int) bool { return c == 0 },
+	"!=": func(c int) bool { return c != 0 },
+	"<":  func(c int) bool { return c < 0 },
+	"<=": func(c int) bool { return c <= 0 },
+	">":  func(c int) bool { return c > 0 },
+	">=": func(c int) bool { return c >= 0 },
+}
+
+// resolveRouting links every route to its column and casts the value it
+// compares against.
+func resolveRouting(config *Config) error {
+	r := config.Routing
+	if r == nil {
+		return nil
+	}
+	if len(r.Routes) == 0 {
+		return fmt.Errorf("routing needs at least one route")
+	}
+	for i := range r.Routes {
+		route := &r.Routes[i]
+		if route.Op == "" {
+			route.Op = "="
+		}
+		if routeOps[route.Op] == nil {
+			return fmt.Errorf("routing: route %d: unknown op %q (use =, !=, <, <=, > or >=)", i+1, route.Op)
+		}
+		if route.Output == "" {
+			return fmt.Errorf("routing: route %d has no output", i+1)
+		}
+		col, ok := routeColumn(config, route.Field)
+		if !ok {
+			return fmt.Errorf("routing: route %d refers to unknown field %q", i+1, route.Field)
+		}
+		value, err := parseValue(route.Value, col)
+		if err != nil {
+			return fmt.Errorf("routing: route %d: value %q isn't a valid %s", i+1, route.Value, col.Type)
+		}
+		route.label, route.value = col.Label, value
+		route.target = parseRouteTarget(route.Output)
+	}
+	if r.Default != "" {
+		target := parseRouteTarget(r.Default)
+		r.defaultTarget = &target
+	}
+	return nil
+}
+
+// routeColumn finds the column named by field or label.
+func routeColumn(config *Config, name string) (ColumnConfig, bool) {
+	for _, col := range config.Columns {
+		if !isComputed(col) && len(col.Repeat) == 0 && (col.Field == name || col.Label == name) {
+			return col, true
+		}
+	}
+	return ColumnConfig{}, false
+}
+
+// parseRouteTarget reads a route output the way -output is read.
+func parseRouteTarget(output string) outputTarget {
+	var targets outputList
+	targets.Set(output)
+	targets.resolveFormats("json")
+	return targets[0]
+}
+
+// matches reports whether record satisfies the route. Null and missing
+// values only match "!=".
+func (r Route) matches(record map[string]interface{}) bool {
+	value := record[r.label]
+	if value == nil {
+		return r.Op == "!="
+	}
+	return routeOps[r.Op](compareValues(value, r.value))
+}
+
+// routedRecords are the records bound for one output.
+type routedRecords struct {
+	target  outputTarget
+	records []map[string]interface{}
+}
+
+// targets returns every output of the routing, each once, in config order.
+func (r *RoutingConfig) targets() outputList {
+	var targets outputList
+	seen := make(map[string]bool)
+	for _, route := range r.Routes {
+		if !seen[route.target.Path] {
+			seen[route.target.Path] = true
+			targets = append(targets, route.target)
+		}
+	}
+	if r.defaultTarget != nil && !seen[r.defaultTarget.Path] {
+		targets = append(targets, *r.defaultTarget)
+	}
+	return targets
+}
+
+// routeRecords splits records between the routing outputs, keeping their
+// order. Routes sharing an output share its records.
+func routeRecords(records []map[string]interface{}, r *RoutingConfig) []routedRecords {
+	targets := r.targets()
+	parts := make([]routedRecords, len(targets))
+	index := make(map[string]int, len(targets))
+	for i, target := range targets {
+		parts[i].target = target
+		index[target.Path] = i
+	}
+
+	for _, record := range records {
+		path := ""
+		for _, route := range r.Routes {
+			if route.matches(record) {
+				path = route.target.Path
+				break
+			}
+		}
+		if path == "" && r.defaultTarget != nil {
+			path = r.defaultTarget.Path
+		}
+		if path != "" {
+			parts[index[path]].records = append(parts[index[path]].records, record)
+		}
+	}
+	return parts
+}
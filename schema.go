@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+)
+
+// jsonSchema is the subset of a JSON Schema object definition used to derive
+// column types.
+type jsonSchema struct {
+	Properties map[string]jsonSchemaProperty `json:"properties"`
+}
+
+type jsonSchemaProperty struct {
+	// Type is either a single type name or a list such as ["integer", "null"]
+	Type   interface{} `json:"type"`
+	Format string      `json:"format"`
+}
+
+func loadJSONSchema(filename string) (*jsonSchema, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var schema jsonSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// columnType maps the property to a column type and reports whether null is
+// allowed.
+func (p jsonSchemaProperty) columnType() (string, bool) {
+	var types []string
+	switch t := p.Type.(type) {
+	case string:
+		types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			if s, ok := v.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+
+	columnType, nullable := "string", false
+	for _, t := range types {
+		switch t {
+		case "null":
+			nullable = true
+		case "integer":
+			columnType = "int"
+		case "number":
+			columnType = "float"
+		case "boolean":
+			columnType = "bool"
+		case "string":
+			switch p.Format {
+			case "date-time":
+				columnType = "datetime"
+			case "date":
+				columnType = "date"
+			}
+		}
+	}
+	return columnType, nullable
+}
+
+// applySchema sets the type of every column whose label or field matches a
+// schema property, and adds string-labelled columns for the remaining
+// properties found in the header.
+func applySchema(config *Config, schema *jsonSchema, header []string) {
+	matched := make(map[string]bool, len(schema.Properties))
+	apply := func(col *ColumnConfig, prop jsonSchemaProperty) {
+		columnType, nullable := prop.columnType()
+		col.Type = columnType
+		if nullable && col.TypePolicy == "" {
+			col.TypePolicy = "nullable"
+		}
+	}
+
+	for i := range config.Columns {
+		col := &config.Columns[i]
+		for _, name := range []string{col.Label, col.Field} {
+			if prop, ok := schema.Properties[name]; ok {
+				apply(col, prop)
+				matched[name] = true
+				break
+			}
+		}
+	}
+
+	for index, name := range header {
+		prop, ok := schema.Properties[name]
+		if !ok || matched[name] {
+			continue
+		}
+		col := ColumnConfig{Index: index, Field: name, Label: name}
+		apply(&col, prop)
+		config.Columns = append(config.Columns, col)
+		matched[name] = true
+	}
+
+	var missing []string
+	for name := range schema.Properties {
+		if !matched[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		log.Printf("Warning: schema property %s matches no column or header field", name)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import "strconv"
+
+// benchSeed seeds the -bench dataset when -seed isn't given, so datasets of
+// the same size stay comparable across commits.
+const benchSeed = 1
+
+// seedFlag is the -seed flag. It remembers whether it was given, so the
+// -bench dataset can fall back to benchSeed.
+type seedFlag struct {
+	value int64
+	set   bool
+}
+
+func (s *seedFlag) String() string {
+	if !s.set {
+		return ""
+	}
+	return strconv.FormatInt(s.value, 10)
+}
+
+func (s *seedFlag) Set(value string) error {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+	s.value, s.set = n, true
+	return nil
+}
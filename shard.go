@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// shardReader returns the part of a file holding the records that start in
+// the byte range [start, end), so several runs can split one file between
+// them. A record belongs to the shard holding its first byte: a shard that
+// starts mid-record skips to the next line, and the last record may run past
+// end. With header, the file's first line is returned first in every shard.
+// An end of 0 or less means the end of the file. Records are found by "\n",
+// so quoted fields holding line breaks can throw the alignment off.
+func shardReader(f io.ReadSeeker, start, end int64, header bool) (io.Reader, error) {
+	var first []byte
+	offset := int64(0)
+	if header {
+		var err error
+		first, err = bufio.NewReader(f).ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		offset = int64(len(first))
+	}
+
+	// Look one byte back so a record starting exactly at start is kept
+	if start > offset {
+		offset = start - 1
+	} else {
+		start = offset
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	if offset < start {
+		skipped, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		offset += int64(len(skipped))
+	}
+
+	records := &rangeReader{r: r, pos: offset, end: end}
+	return io.MultiReader(bytes.NewReader(first), records), nil
+}
+
+// rangeReader passes on whole lines of r until one starts at or after end.
+type rangeReader struct {
+	r    *bufio.Reader
+	pos  int64
+	end  int64
+	line []byte
+}
+
+func (s *rangeReader) Read(p []byte) (int, error) {
+	if len(s.line) == 0 {
+		if s.end > 0 && s.pos >= s.end {
+			return 0, io.EOF
+		}
+		line, err := s.r.ReadBytes('\n')
+		if len(line) == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		s.line = line
+		s.pos += int64(len(line))
+	}
+	n := copy(p, s.line)
+	s.line = s.line[n:]
+	return n, nil
+}
+
+// checkShard validates -start-offset and -end-offset.
+func checkShard(opts options) error {
+	switch {
+	case opts.startOffset < 0 || opts.endOffset < 0:
+		return fmt.Errorf("-start-offset and -end-offset can't be negative")
+	case opts.endOffset > 0 && opts.endOffset <= opts.startOffset:
+		return fmt.Errorf("-end-offset must be greater than -start-offset")
+	case isURL(opts.inputFile) || isXLSX(opts.inputFile):
+		return fmt.Errorf("-start-offset and -end-offset need a local CSV or NDJSON file")
+	case opts.follow:
+		return fmt.Errorf("-start-offset and -end-offset can't be combined with -follow")
+	}
+	return nil
+}
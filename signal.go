@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// interruptFlag is set once SIGINT or SIGTERM arrives during processing.
+// After the first signal the default handlers are restored, so a second one
+// ends the process straight away.
+// An expired deadline counts as an interrupt too.
+type interruptFlag struct {
+	set      atomic.Bool
+	stop     chan struct{}
+	deadline *runDeadline
+}
+
+func watchInterrupts(deadline *runDeadline) *interruptFlag {
+	f := &interruptFlag{stop: make(chan struct{}), deadline: deadline}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			log.Printf("Received %v, finishing rows in progress and writing partial output (repeat to abort)", sig)
+			f.set.Store(true)
+		case <-f.stop:
+		}
+	}()
+	return f
+}
+
+func (f *interruptFlag) interrupted() bool { return f.set.Load() || f.deadline.passed() }
+
+// done stops watching for signals.
+func (f *interruptFlag) done() { close(f.stop) }
+
+// runDeadline expires once -timeout has elapsed since the run started. A zero
+// limit never expires. ctx is done at the deadline too, so requests that
+// stall, such as fetching a URL input, are cancelled.
+type runDeadline struct {
+	limit   time.Duration
+	expired atomic.Bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timer   *time.Timer
+}
+
+func startDeadline(limit time.Duration) *runDeadline {
+	d := &runDeadline{limit: limit, ctx: context.Background()}
+	if limit > 0 {
+		d.ctx, d.cancel = context.WithTimeout(d.ctx, limit)
+		d.timer = time.AfterFunc(limit, func() {
+			log.Printf("Timed out after %v, finishing rows in progress and writing partial output", limit)
+			d.expired.Store(true)
+		})
+	}
+	return d
+}
+
+// stop releases the timer and context of a run that is over, so a deadline
+// left over from an earlier -manifest job or -bench run never fires.
+func (d *runDeadline) stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.cancel()
+	}
+}
+
+func (d *runDeadline) passed() bool { return d.expired.Load() }
+
+func (d *runDeadline) err() error { return fmt.Errorf("timed out after %v", d.limit) }
+
+// deadlineReader fails reads once the deadline has passed, so reading a slow
+// or huge input is bounded too.
+type deadlineReader struct {
+	r        io.Reader
+	deadline *runDeadline
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	if r.deadline.passed() {
+		return 0, r.deadline.err()
+	}
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.deadline.ctx.Err() != nil {
+		// A read cancelled by the deadline's context
+		err = r.deadline.err()
+	}
+	return n, err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sortKey is one field of a -sort option.
+type sortKey struct {
+	label string
+	desc  bool
+}
+
+// parseSortKeys parses a -sort value such as "city,age:desc". Fields name
+// config columns (by field or label) or constants; with a pivot any output key
+// is accepted, since pivoted keys come from the data.
+func parseSortKeys(spec string, config *Config) ([]sortKey, error) {
+	labels := outputLabels(config)
+
+	var keys []sortKey
+	for _, part := range strings.Split(spec, ",") {
+		name, order, _ := strings.Cut(strings.TrimSpace(part), ":")
+		key := sortKey{label: name}
+		switch order {
+		case "", "asc":
+		case "desc":
+			key.desc = true
+		default:
+			return nil, fmt.Errorf("field %s: unknown sort order %q (use asc or desc)", name, order)
+		}
+		if label, ok := labels[name]; ok {
+			key.label = label
+		} else if config.Pivot == nil {
+			return nil, fmt.Errorf("unknown sort field %q", name)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// outputLabels maps the names an option may use for an output field, column
+// fields and labels or constants, to the output key.
+func outputLabels(config *Config) map[string]string {
+	labels := make(map[string]string, 2*len(config.Columns)+len(config.Constants))
+	for _, col := range config.Columns {
+		labels[col.Field] = col.Label
+		labels[col.Label] = col.Label
+	}
+	for name := range config.Constants {
+		labels[name] = name
+	}
+	return labels
+}
+
+// columnLabels returns the column labels in config order, or the keys in
+// output_order when it is set.
+func columnLabels(config *Config) []string {
+	if config.outputOrder != nil {
+		return config.outputOrder
+	}
+	labels := make([]string, len(config.Columns))
+	for i, col := range config.Columns {
+		labels[i] = col.Label
+	}
+	return labels
+}
+
+// sortRecords orders records by the keys, keeping the existing order of
+// records that compare equal. Nulls and missing fields sort last regardless
+// of direction.
+func sortRecords(records []map[string]interface{}, keys []sortKey) {
+	sort.SliceStable(records, func(i, j int) bool {
+		for _, key := range keys {
+			a, b := records[i][key.label], records[j][key.label]
+			switch {
+			case a == nil && b == nil:
+				continue
+			case a == nil:
+				return false
+			case b == nil:
+				return true
+			}
+			c := compareValues(a, b)
+			if c == 0 {
+				continue
+			}
+			if key.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+// compareValues compares two non-nil output values. Numbers, times and bools
+// compare by value; anything else, including mixed types, by its text.
+func compareValues(a, b interface{}) int {
+	if x, ok := sortNumber(a); ok {
+		if y, ok := sortNumber(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, ok := a.(time.Time); ok {
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y)
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// sortNumber returns the numeric value of numbers and bools (false < true).
+func sortNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case boolValue:
+		if v.value {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FieldType is a named column type of a -types library, such as zip_code,
+// defined in terms of a base type. Pattern must match the whole value after
+// the Pipeline steps, and Format and Default apply to columns that don't set
+// their own.
+type FieldType struct {
+	Type     string   `yaml:"type"`
+	Pattern  string   `yaml:"pattern"`
+	Pipeline []string `yaml:"pipeline"`
+	Format   string   `yaml:"format"`
+	Default  string   `yaml:"default"`
+}
+
+// loadTypeLibrary reads a YAML mapping of type names to their definitions.
+func loadTypeLibrary(filename string) (map[string]FieldType, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var library map[string]FieldType
+	if err := yaml.Unmarshal(data, &library); err != nil {
+		return nil, err
+	}
+	for name, def := range library {
+		if _, custom := library[def.Type]; custom {
+			return nil, fmt.Errorf("type %s: base type %s is itself a library type", name, def.Type)
+		}
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("type names can't be empty")
+		}
+	}
+	return library, nil
+}
+
+// applyTypeLibrary replaces the library types of columns, and of repeat
+// column elements, with their base type. The column's own pipeline runs
+// before the type's steps and pattern.
+func applyTypeLibrary(columns []ColumnConfig, library map[string]FieldType) {
+	for i := range columns {
+		col := &columns[i]
+		applyTypeLibrary(col.Repeat, library)
+		def, ok := library[col.Type]
+		if !ok {
+			continue
+		}
+		col.Type = def.Type
+		pipeline := append(append([]string(nil), col.Pipeline...), def.Pipeline...)
+		if def.Pattern != "" {
+			pipeline = append(pipeline, "validate:"+def.Pattern)
+		}
+		col.Pipeline = pipeline
+		if col.Format == "" {
+			col.Format = def.Format
+		}
+		if col.Default == "" {
+			col.Default = def.Default
+		}
+	}
+}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// boolValue is a bool that marshals to JSON in a configurable form.
+type boolValue struct {
+	value  bool
+	format string
+}
+
+func (b boolValue) String() string {
+	switch b.format {
+	case "1/0":
+		if b.value {
+			return "1"
+		}
+		return "0"
+	case "yes/no":
+		if b.value {
+			return "yes"
+		}
+		return "no"
+	default:
+		return strconv.FormatBool(b.value)
+	}
+}
+
+func (b boolValue) MarshalJSON() ([]byte, error) {
+	if b.format == "yes/no" {
+		return []byte(strconv.Quote(b.String())), nil
+	}
+	return []byte(b.String()), nil
+}
+
+// moneyValue is a money column value, written as an object so the amount is
+// never separated from its currency.
+type moneyValue struct {
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+}
+
+func (m moneyValue) String() string {
+	return strings.TrimSpace(strconv.FormatFloat(m.Amount, 'f', -1, 64) + " " + m.Currency)
+}
+
+// quantityValue is a quantity column value, a number with its unit such as
+// 12kg, written as an object with both.
+type quantityValue struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+func (q quantityValue) String() string {
+	return strconv.FormatFloat(q.Value, 'f', -1, 64) + q.Unit
+}
+
+// quantityPattern splits a quantity into its number and unit suffix.
+var quantityPattern = regexp.MustCompile(`^([+-]?(?:\d+(?:\.\d*)?|\.\d+)(?:[eE][+-]?\d+)?)\s*(.*)$`)
+
+// parseQuantity splits value into a number and a unit. With units the unit
+// must be one of them, and the number is converted to the base unit.
+func parseQuantity(value string, col ColumnConfig) (quantityValue, error) {
+	parts := quantityPattern.FindStringSubmatch(strings.TrimSpace(value))
+	if parts == nil {
+		return quantityValue{}, fmt.Errorf("%q doesn't start with a number", value)
+	}
+	number, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return quantityValue{}, err
+	}
+	q := quantityValue{Value: number, Unit: strings.TrimSpace(parts[2])}
+	if col.Units == nil {
+		return q, nil
+	}
+	factor, ok := col.Units[q.Unit]
+	if !ok {
+		return quantityValue{}, fmt.Errorf("unknown unit %q", q.Unit)
+	}
+	return quantityValue{Value: number * factor, Unit: col.BaseUnit}, nil
+}
+
+// resolveCurrencies checks money columns and points those with a
+// currency_field at its index.
+func resolveCurrencies(config *Config) error {
+	indexes := make(map[string]int, len(config.Columns))
+	for _, col := range config.Columns {
+		if !isComputed(col) {
+			indexes[col.Field] = col.Index
+		}
+	}
+	for i, col := range config.Columns {
+		if col.Type != "money" {
+			if col.Currency != "" || col.CurrencyField != "" {
+				return fmt.Errorf("column %s: currency and currency_field need type money", col.Field)
+			}
+			continue
+		}
+		switch {
+		case col.Currency != "" && col.CurrencyField != "":
+			return fmt.Errorf("column %s: set either currency or currency_field", col.Field)
+		case col.Currency == "" && col.CurrencyField == "":
+			return fmt.Errorf("column %s: money columns need currency or currency_field", col.Field)
+		case col.CurrencyField != "":
+			index, ok := indexes[col.CurrencyField]
+			if !ok {
+				return fmt.Errorf("column %s: unknown currency_field %q", col.Field, col.CurrencyField)
+			}
+			config.Columns[i].currencyIndex = index
+		}
+	}
+	return nil
+}
+
+// withCurrency fills in the currency of a money value from the row. A row
+// without one keeps an empty currency.
+func withCurrency(value interface{}, row []string, col ColumnConfig) interface{} {
+	m, ok := value.(moneyValue)
+	if !ok {
+		return value
+	}
+	if col.currencyIndex < len(row) {
+		m.Currency = strings.TrimSpace(row[col.currencyIndex])
+	}
+	return m
+}
+
+// isNumeric reports whether a column type produces float or int values.
+func isNumeric(columnType string) bool {
+	switch columnType {
+	case "int", "float", "latitude", "longitude", "enum":
+		return true
+	}
+	return false
+}
+
+// adjustNumber applies the column's scale and then its rounding to a cast
+// numeric value. Other values are returned unchanged.
+func adjustNumber(v interface{}, col ColumnConfig) interface{} {
+	if col.Scale == nil && col.Round == nil {
+		return v
+	}
+	var n float64
+	switch x := v.(type) {
+	case int:
+		if col.Scale == nil {
+			// Rounding an int only matters for negative places, e.g. to tens
+			return int(roundTo(float64(x), *col.Round))
+		}
+		n = float64(x)
+	case float64:
+		n = x
+	default:
+		return v
+	}
+	if col.Scale != nil {
+		// Dividing by 100 is exact where multiplying by 0.01 is not, so
+		// fractional scales with a whole inverse divide
+		if inverse := 1 / *col.Scale; *col.Scale < 1 && inverse == math.Trunc(inverse) {
+			n /= inverse
+		} else {
+			n *= *col.Scale
+		}
+	}
+	if col.Round != nil {
+		n = roundTo(n, *col.Round)
+	}
+	return n
+}
+
+// roundTo rounds n half away from zero to the given number of decimal places.
+func roundTo(n float64, places int) float64 {
+	factor := math.Pow(10, float64(places))
+	return math.Round(n*factor) / factor
+}
+
+// parseCoordinate parses a latitude or longitude and checks that it lies
+// within -limit..limit.
+func parseCoordinate(value string, limit float64) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v < -limit || v > limit {
+		return 0, fmt.Errorf("%s is outside -%g..%g", value, limit, limit)
+	}
+	return v, nil
+}
+
+// parseIP validates an IP address of the given column type ("ip" accepts
+// both families). With normalize the canonical form is returned, e.g.
+// "2001:db8::1" for "2001:0db8:0000::0001".
+func parseIP(value, columnType string, normalize bool) (string, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", fmt.Errorf("%q is not an IP address", value)
+	}
+	isV4 := ip.To4() != nil && !strings.Contains(value, ":")
+	switch {
+	case columnType == "ipv4" && !isV4:
+		return "", fmt.Errorf("%q is not an IPv4 address", value)
+	case columnType == "ipv6" && isV4:
+		return "", fmt.Errorf("%q is not an IPv6 address", value)
+	}
+	if normalize {
+		return ip.String(), nil
+	}
+	return value, nil
+}
+
+// parsePhone parses a phone number in any common notation and returns it in
+// E.164 form, such as "+14155552671". Numbers without a country code are read
+// as numbers of region.
+func parsePhone(value, region string) (string, error) {
+	number, err := phonenumbers.Parse(value, strings.ToUpper(region))
+	if err != nil {
+		return "", fmt.Errorf("%q is not a phone number: %v", value, err)
+	}
+	if !phonenumbers.IsValidNumber(number) {
+		return "", fmt.Errorf("%q is not a valid phone number", value)
+	}
+	return phonenumbers.Format(number, phonenumbers.E164), nil
+}
+
+// decodeBase64 decodes standard or URL-safe base64, padded or not, and
+// requires the result to be UTF-8 text.
+func decodeBase64(value string) (string, error) {
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		decoded, err := encoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		if !utf8.Valid(decoded) {
+			return "", fmt.Errorf("decoded base64 is not UTF-8 text")
+		}
+		return string(decoded), nil
+	}
+	return "", fmt.Errorf("%q is not valid base64", value)
+}
+
+// parseEnum maps a value to its code. The default may also be given as a
+// bare code, so unmapped values can fall back to e.g. -1 without mapping it.
+func parseEnum(value string, col ColumnConfig) (int, error) {
+	if code, ok := col.Codes[value]; ok {
+		return code, nil
+	}
+	if value == col.Default {
+		if code, err := strconv.Atoi(value); err == nil {
+			return code, nil
+		}
+	}
+	return 0, fmt.Errorf("%q has no enum code", value)
+}
+
+// parseDuration accepts Go durations such as "1h30m" or "90m" and ISO 8601
+// durations such as "PT1H30M" or "P1DT12H". ISO years and months are rejected
+// because their length varies.
+func parseDuration(value string) (time.Duration, error) {
+	if !strings.HasPrefix(value, "P") && !strings.HasPrefix(value, "-P") {
+		return time.ParseDuration(value)
+	}
+
+	s, sign := value, time.Duration(1)
+	if strings.HasPrefix(s, "-") {
+		s, sign = s[1:], -1
+	}
+	s = s[1:]
+	if s == "" || s == "T" {
+		return 0, fmt.Errorf("invalid ISO 8601 duration %q", value)
+	}
+
+	var total time.Duration
+	inTime := false
+	for s != "" {
+		if s[0] == 'T' {
+			if inTime {
+				return 0, fmt.Errorf("invalid ISO 8601 duration %q", value)
+			}
+			inTime = true
+			s = s[1:]
+			continue
+		}
+		end := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' && r != ',' })
+		if end <= 0 {
+			return 0, fmt.Errorf("invalid ISO 8601 duration %q", value)
+		}
+		n, err := strconv.ParseFloat(strings.Replace(s[:end], ",", ".", 1), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid ISO 8601 duration %q", value)
+		}
+
+		var unit time.Duration
+		switch {
+		case !inTime && s[end] == 'W':
+			unit = 7 * 24 * time.Hour
+		case !inTime && s[end] == 'D':
+			unit = 24 * time.Hour
+		case inTime && s[end] == 'H':
+			unit = time.Hour
+		case inTime && s[end] == 'M':
+			unit = time.Minute
+		case inTime && s[end] == 'S':
+			unit = time.Second
+		default:
+			return 0, fmt.Errorf("unsupported ISO 8601 duration %q", value)
+		}
+		total += time.Duration(n * float64(unit))
+		s = s[end+1:]
+	}
+	return sign * total, nil
+}
+
+// formatDuration renders a duration as nanoseconds (the default) or, with the
+// "string" format, as a normalized Go duration string such as "1h30m0s".
+func formatDuration(d time.Duration, format string) interface{} {
+	if format == "string" {
+		return d.String()
+	}
+	return int64(d)
+}
+
+// validateColumnOptions rejects unknown values for type-specific options.
+func validateColumnOptions(config *Config) error {
+	switch config.NullRatePolicy {
+	case "", "error", "warn":
+	default:
+		return fmt.Errorf("unsupported null_rate_policy %q (use error or warn)", config.NullRatePolicy)
+	}
+	if config.SkipTrailingRows < 0 {
+		return fmt.Errorf("skip_trailing_rows can't be negative")
+	}
+	if config.HeaderRows < 0 || (config.HeaderRows > 1 && !config.Header) {
+		return fmt.Errorf("header_rows needs header: true and can't be negative")
+	}
+	if config.RowNumberStart != nil && config.RowNumberKey == "" {
+		return fmt.Errorf("row_number_start needs a row_number_key")
+	}
+	for _, col := range config.Columns {
+		if col.Index < 0 {
+			return fmt.Errorf("column %s: index %d can't be negative", col.Field, col.Index)
+		}
+		if col.Region != "" && (col.Type != "phone" || !phonenumbers.GetSupportedRegions()[strings.ToUpper(col.Region)]) {
+			return fmt.Errorf("column %s: region needs a phone column and a supported region code such as US, got %q", col.Field, col.Region)
+		}
+		if (col.Units != nil || col.BaseUnit != "") && (col.Type != "quantity" || col.Units == nil || col.BaseUnit == "") {
+			return fmt.Errorf("column %s: units and base_unit go together, on a quantity column", col.Field)
+		}
+		if err := validateAggregates(col); err != nil {
+			return err
+		}
+		switch col.Unnest {
+		case "", "explode", "join":
+		default:
+			return fmt.Errorf("column %s: unsupported unnest %q (use explode or join)", col.Field, col.Unnest)
+		}
+		if (col.MinLength != nil && *col.MinLength < 0) || (col.MaxLength != nil && *col.MaxLength < 0) {
+			return fmt.Errorf("column %s: min_length and max_length can't be negative", col.Field)
+		}
+		if col.MinLength != nil && col.MaxLength != nil && *col.MinLength > *col.MaxLength {
+			return fmt.Errorf("column %s: min_length is greater than max_length", col.Field)
+		}
+		if col.Truncate && col.MaxLength == nil {
+			return fmt.Errorf("column %s: truncate needs max_length", col.Field)
+		}
+		if col.MaxNullRate != nil && (*col.MaxNullRate < 0 || *col.MaxNullRate > 1) {
+			return fmt.Errorf("column %s: max_null_rate must be between 0 and 1", col.Field)
+		}
+		switch col.DurationFormat {
+		case "", "nanoseconds", "string":
+		default:
+			return fmt.Errorf("column %s: unsupported duration_format %q", col.Field, col.DurationFormat)
+		}
+		if (col.Scale != nil || col.Round != nil) && !isNumeric(col.Type) {
+			return fmt.Errorf("column %s: scale and round need a numeric type", col.Field)
+		}
+		if col.Type == "enum" && len(col.Codes) == 0 {
+			return fmt.Errorf("column %s: enum columns need codes", col.Field)
+		}
+		switch col.QuotedEmpty {
+		case "", "missing", "empty", "null":
+		default:
+			return fmt.Errorf("column %s: unsupported quoted_empty %q", col.Field, col.QuotedEmpty)
+		}
+	}
+	return nil
+}
+
+// resolveBoolFormats applies the global bool_format to columns that don't set
+// their own and rejects unknown formats.
+func resolveBoolFormats(config *Config) error {
+	for i, col := range config.Columns {
+		if col.BoolFormat == "" {
+			config.Columns[i].BoolFormat = config.BoolFormat
+		}
+		switch config.Columns[i].BoolFormat {
+		case "", "true/false", "1/0", "yes/no":
+		default:
+			return fmt.Errorf("column %s: unsupported bool_format %q", col.Field, config.Columns[i].BoolFormat)
+		}
+	}
+	return nil
+}
+
+// resolveControlChars applies the global control_chars to columns that don't
+// set their own and rejects unknown policies.
+func resolveControlChars(config *Config) error {
+	for i, col := range config.Columns {
+		if col.ControlChars == "" {
+			config.Columns[i].ControlChars = config.ControlChars
+		}
+		switch config.Columns[i].ControlChars {
+		case "", "keep", "strip", "space", "reject":
+		default:
+			return fmt.Errorf("column %s: unsupported control_chars %q (use keep, strip, space or reject)", col.Field, config.Columns[i].ControlChars)
+		}
+	}
+	return nil
+}
+
+// isControlChar reports whether r is a control character control_chars acts
+// on. Tabs and line breaks are left alone, as they are common in free text
+// and JSON escapes them.
+func isControlChar(r rune) bool {
+	return unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r'
+}
+
+// cleanControlChars applies the column's control_chars policy to a raw
+// value. Rejected values follow the column's type_policy.
+func cleanControlChars(value string, col ColumnConfig) (string, error) {
+	if col.ControlChars == "" || col.ControlChars == "keep" || strings.IndexFunc(value, isControlChar) < 0 {
+		return value, nil
+	}
+	switch col.ControlChars {
+	case "strip":
+		return strings.Map(func(r rune) rune {
+			if isControlChar(r) {
+				return -1
+			}
+			return r
+		}, value), nil
+	case "space":
+		return strings.Map(func(r rune) rune {
+			if isControlChar(r) {
+				return ' '
+			}
+			return r
+		}, value), nil
+	}
+	return value, fmt.Errorf("Value %q for column %s contains control characters", value, col.Field)
+}
+
+// strftimeLayouts maps strftime directives to Go layout elements. Numeric
+// fields use the unpadded Go forms so that, like strptime, both "3" and "03"
+// are accepted.
+var strftimeLayouts = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "1",
+	'd': "2",
+	'H': "15",
+	'I': "3",
+	'M': "4",
+	'S': "5",
+	'f': "000000",
+	'p': "PM",
+	'b': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'z': "-0700",
+	'Z': "MST",
+	'%': "%",
+}
+
+// strftimeLayout converts a strftime-style format into a Go time layout.
+func strftimeLayout(format string) (string, error) {
+	var layout strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			layout.WriteByte(format[i])
+			continue
+		}
+		if i+1 == len(format) {
+			return "", fmt.Errorf("format %q ends with a lone %%", format)
+		}
+		i++
+		element, ok := strftimeLayouts[format[i]]
+		if !ok {
+			return "", fmt.Errorf("format %q uses unsupported directive %%%c", format, format[i])
+		}
+		layout.WriteString(element)
+	}
+	return layout.String(), nil
+}
+
+// resolveLayouts sets the Go time layout and timezone of every date and
+// datetime column, and of the elements of typed array columns.
+func resolveLayouts(config *Config) error {
+	for i := range config.Columns {
+		col := &config.Columns[i]
+		if col.Type == "array" && col.Items != "" {
+			item := ColumnConfig{
+				Field:          col.Field,
+				Type:           col.Items,
+				Format:         col.Format,
+				Timezone:       col.Timezone,
+				BoolFormat:     col.BoolFormat,
+				DurationFormat: col.DurationFormat,
+			}
+			layout, err := layoutFor(item)
+			if err != nil {
+				return fmt.Errorf("column %s: %v", col.Field, err)
+			}
+			item.layout = layout
+			if item.location, err = locationFor(item); err != nil {
+				return fmt.Errorf("column %s: %v", col.Field, err)
+			}
+			col.itemColumn = &item
+			continue
+		}
+		layout, err := layoutFor(*col)
+		if err != nil {
+			return fmt.Errorf("column %s: %v", col.Field, err)
+		}
+		col.layout = layout
+		if col.location, err = locationFor(*col); err != nil {
+			return fmt.Errorf("column %s: %v", col.Field, err)
+		}
+	}
+	return nil
+}
+
+// locationFor loads the timezone of a datetime column, if it has one. Dates
+// have no time of day to convert, and values whose layout carries a zone,
+// offset or literal Z are already placed in time, so neither takes one.
+func locationFor(col ColumnConfig) (*time.Location, error) {
+	if col.Timezone == "" {
+		return nil, nil
+	}
+	if col.Type != "datetime" {
+		return nil, fmt.Errorf("timezone only applies to datetime values")
+	}
+	if strings.Contains(col.layout, "Z") || strings.Contains(col.layout, "-07") || strings.Contains(col.layout, "MST") {
+		return nil, fmt.Errorf("timezone can't be combined with a format that has a zone, offset or literal Z")
+	}
+	return time.LoadLocation(col.Timezone)
+}
+
+func layoutFor(col ColumnConfig) (string, error) {
+	switch {
+	case col.Type != "date" && col.Type != "datetime":
+		return "", nil
+	case col.Format != "":
+		return strftimeLayout(col.Format)
+	case col.Type == "date":
+		return "2006-01-02", nil
+	default:
+		return "2006-01-02T15:04:05Z", nil
+	}
+}
+
+// parseArray decodes a JSON array cell. When item is set every element is
+// converted to that column type, and any element that fails fails the cell.
+func parseArray(value string, item *ColumnConfig) ([]interface{}, error) {
+	var elements []interface{}
+	if err := json.Unmarshal([]byte(value), &elements); err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return elements, nil
+	}
+
+	for i, element := range elements {
+		var raw string
+		switch v := element.(type) {
+		case nil:
+			continue
+		case string:
+			raw = v
+		case float64:
+			raw = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			raw = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("element %d is not a scalar", i)
+		}
+		converted, err := parseValue(raw, *item)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %v", i, err)
+		}
+		elements[i] = converted
+	}
+	return elements, nil
+}
+
+// checkLength checks a raw value against the column's min_length and
+// max_length, counted in characters. Too long values are cut to max_length
+// when the column truncates, with a warning. Defaults are trusted and not
+// checked.
+func checkLength(value string, col ColumnConfig, defaulted bool) (string, string, error) {
+	if defaulted || value == "" || (col.MinLength == nil && col.MaxLength == nil) {
+		return value, "", nil
+	}
+	n := utf8.RuneCountInString(value)
+	if col.MaxLength != nil && n > *col.MaxLength {
+		if col.Truncate {
+			return string([]rune(value)[:*col.MaxLength]), fmt.Sprintf("truncated from %d to %d characters", n, *col.MaxLength), nil
+		}
+		return value, "", fmt.Errorf("Value %s for column %s is longer than max_length %d", value, col.Field, *col.MaxLength)
+	}
+	if col.MinLength != nil && n < *col.MinLength {
+		return value, "", fmt.Errorf("Value %s for column %s is shorter than min_length %d", value, col.Field, *col.MinLength)
+	}
+	return value, "", nil
+}
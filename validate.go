@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// contractSchema is the subset of JSON Schema used to validate output
+// records: type, enum, required, properties, additionalProperties (as a
+// bool), items, numeric and length bounds, pattern, and the date and
+// date-time formats.
+type contractSchema struct {
+	Type                 interface{}                `json:"type"`
+	Enum                 []interface{}              `json:"enum"`
+	Required             []string                   `json:"required"`
+	Properties           map[string]*contractSchema `json:"properties"`
+	AdditionalProperties interface{}                `json:"additionalProperties"`
+	Items                *contractSchema            `json:"items"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	Pattern              string                     `json:"pattern"`
+	Format               string                     `json:"format"`
+
+	pattern *regexp.Regexp
+}
+
+func loadContractSchema(filename string) (*contractSchema, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var schema contractSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+	if err := schema.compile(); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// compile prepares the patterns of the schema and its subschemas.
+func (s *contractSchema) compile() error {
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	for name, prop := range s.Properties {
+		if err := prop.compile(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+	return nil
+}
+
+// validateRecord checks a record as it will appear in JSON output and returns
+// one message per violation.
+func (s *contractSchema) validateRecord(entry map[string]interface{}) ([]string, error) {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return nil, err
+	}
+	var errs []string
+	s.validate(value, "", &errs)
+	return errs, nil
+}
+
+func (s *contractSchema) validate(value interface{}, path string, errs *[]string) {
+	fail := func(format string, args ...interface{}) {
+		name := path
+		if name == "" {
+			name = "record"
+		}
+		*errs = append(*errs, name+": "+fmt.Sprintf(format, args...))
+	}
+
+	if types := s.types(); len(types) > 0 && !matchesType(value, types) {
+		fail("expected %s, got %s", strings.Join(types, " or "), jsonTypeOf(value))
+		return
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) && jsonTypeOf(allowed) == jsonTypeOf(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("%v is not one of the allowed values", value)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property %s", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if allowed, isBool := s.AdditionalProperties.(bool); isBool && !allowed {
+					fail("unexpected property %s", name)
+				}
+				continue
+			}
+			prop.validate(v[name], joinPath(path, name), errs)
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, element := range v {
+				s.Items.validate(element, joinPath(path, fmt.Sprint(i)), errs)
+			}
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail("%v is less than the minimum %v", v, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			fail("%v is greater than the maximum %v", v, *s.Maximum)
+		}
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("is shorter than %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("is longer than %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("%q does not match pattern %s", v, s.Pattern)
+		}
+		switch s.Format {
+		case "date":
+			if _, err := time.Parse("2006-01-02", v); err != nil {
+				fail("%q is not a date", v)
+			}
+		case "date-time":
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				fail("%q is not a date-time", v)
+			}
+		}
+	}
+}
+
+// types returns the allowed type names, which may be given as a string or a
+// list.
+func (s *contractSchema) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var types []string
+		for _, v := range t {
+			if name, ok := v.(string); ok {
+				types = append(types, name)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func matchesType(value interface{}, types []string) bool {
+	actual := jsonTypeOf(value)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeOf names the JSON Schema type of a decoded JSON value.
+func jsonTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// rejectedRecord is a record that failed schema validation under the reject
+// policy.
+type rejectedRecord struct {
+	Line   int                    `json:"line"`
+	Errors []string               `json:"errors"`
+	Record map[string]interface{} `json:"record"`
+}
+
+// rejectLog collects rejected records to be written as NDJSON at the end.
+// It is safe for concurrent use.
+type rejectLog struct {
+	mu      sync.Mutex
+	records []rejectedRecord
+}
+
+func (r *rejectLog) add(line int, errs []string, entry map[string]interface{}) {
+	r.mu.Lock()
+	r.records = append(r.records, rejectedRecord{Line: line, Errors: errs, Record: entry})
+	r.mu.Unlock()
+}
+
+// write stores the rejected records sorted by line.
+func (r *rejectLog) write(filename string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sort.SliceStable(r.records, func(i, j int) bool { return r.records[i].Line < r.records[j].Line })
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	for _, record := range r.records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// warningRecord is one data issue found while processing a row.
+type warningRecord struct {
+	Line   int    `json:"line"`
+	Column string `json:"column,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// warningLog either logs row warnings as they happen or, when collecting,
+// keeps them to be written as JSON at the end. It is safe for concurrent use.
+type warningLog struct {
+	mu      sync.Mutex
+	collect bool
+	records []warningRecord
+}
+
+func (w *warningLog) add(line int, column, reason string) {
+	if !w.collect {
+		if column != "" {
+			log.Printf("Warning: line %d, column %s: %s", line, column, reason)
+		} else {
+			log.Printf("Warning: line %d: %s", line, reason)
+		}
+		return
+	}
+	w.mu.Lock()
+	w.records = append(w.records, warningRecord{Line: line, Column: column, Reason: reason})
+	w.mu.Unlock()
+}
+
+func (w *warningLog) addf(line int, column, format string, args ...interface{}) {
+	w.add(line, column, fmt.Sprintf(format, args...))
+}
+
+// write stores the collected warnings sorted by line and column.
+func (w *warningLog) write(filename string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sort.SliceStable(w.records, func(i, j int) bool {
+		a, b := w.records[i], w.records[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	records := w.records
+	if records == nil {
+		records = []warningRecord{}
+	}
+	payload, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, payload, 0644)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// adaptiveInterval is how often -auto-workers measures throughput
+	adaptiveInterval = 100 * time.Millisecond
+	// adaptiveGain is the relative improvement in rows per second a larger
+	// pool must bring to be kept
+	adaptiveGain = 1.05
+)
+
+// processAdaptively calls process for every index below n on a worker pool
+// sized by feedback, and returns the size it settled on. The pool starts with
+// two workers and doubles every interval while throughput improves by
+// adaptiveGain and rows are queued up waiting for workers. Once a doubling
+// doesn't pay off, the pool shrinks back to the previous size and stays
+// there. Intervals in which no row finishes are folded into the next one.
+func processAdaptively(n int, process func(i int)) int {
+	if n == 0 {
+		return 0
+	}
+	jobs := make(chan int, 1024)
+	go func() {
+		for i := 0; i < n; i++ {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		done     atomic.Int64
+		target   atomic.Int32
+		started  int
+		finished = make(chan struct{})
+	)
+	// Workers above the target exit after their current row
+	grow := func(size int) {
+		target.Store(int32(size))
+		for ; started < size; started++ {
+			wg.Add(1)
+			go func(id int32) {
+				defer wg.Done()
+				for id < target.Load() {
+					i, ok := <-jobs
+					if !ok {
+						return
+					}
+					process(i)
+					if done.Add(1) == int64(n) {
+						close(finished)
+					}
+				}
+			}(int32(started))
+		}
+	}
+
+	maxWorkers := 64 * runtime.GOMAXPROCS(0)
+	workers, previous := 2, 2
+	grow(workers)
+
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+	best, last, lastTime := 0.0, int64(0), time.Now()
+	for settled := false; ; {
+		select {
+		case <-finished:
+			wg.Wait()
+			return workers
+		case now := <-ticker.C:
+			count := done.Load()
+			if count == last {
+				// No row finished yet, such as with slow rows; measure over
+				// a longer window instead of counting it as a failed step
+				continue
+			}
+			rate := float64(count-last) / now.Sub(lastTime).Seconds()
+			last, lastTime = count, now
+			if settled {
+				continue
+			}
+			backlog := len(jobs) > cap(jobs)/2
+			switch {
+			case rate > best*adaptiveGain && backlog && workers < maxWorkers:
+				best, previous = rate, workers
+				workers = min(2*workers, maxWorkers)
+				grow(workers)
+			case rate > best*adaptiveGain:
+				settled = true
+			default:
+				workers, settled = previous, true
+				target.Store(int32(workers))
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// isXLSX reports whether path names an Excel workbook.
+func isXLSX(path string) bool {
+	if i := strings.IndexAny(path, "?#"); i >= 0 && isURL(path) {
+		path = path[:i]
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".xlsx", ".xlsm":
+		return true
+	}
+	return false
+}
+
+// readXLSX reads every row of a worksheet, the first sheet when sheet is
+// empty. Rows are padded to the same width because excelize drops trailing
+// empty cells.
+func readXLSX(r io.Reader, sheet string, hasHeader bool) ([]string, [][]string, error) {
+	f, err := excelize.OpenReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	if sheet == "" {
+		sheets := f.GetSheetList()
+		if len(sheets) == 0 {
+			return nil, nil, fmt.Errorf("workbook has no sheets")
+		}
+		sheet = sheets[0]
+	}
+	rows, err := f.GetRows(sheet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	width := 0
+	for _, row := range rows {
+		if len(row) > width {
+			width = len(row)
+		}
+	}
+	for i, row := range rows {
+		for len(row) < width {
+			row = append(row, "")
+		}
+		rows[i] = row
+	}
+
+	if hasHeader && len(rows) > 0 {
+		return rows[0], rows[1:], nil
+	}
+	return nil, rows, nil
+}